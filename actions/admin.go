@@ -92,6 +92,14 @@ func BanUserGet(c buffalo.Context) error {
 // ControlPanel renders page for controlling server backend stuff.
 // html contains python deletion at the time of writing this
 func ControlPanel(c buffalo.Context) error {
+	c.Set("py_pool", pyWorkers.Stats())
+	kv := c.Value("kv").(models.KV)
+	uploads, err := kv.Stats(pyDBUploadBucketName)
+	if err != nil {
+		return c.Error(500, err)
+	}
+	c.Set("py_uploads", uploads)
+	c.Set("py_retention", pyRetention)
 	return c.Render(200, r.HTML("curso/control-panel.plush.html"))
 }
 
@@ -7,6 +7,7 @@ import (
 	"github.com/gobuffalo/envy"
 	"github.com/gobuffalo/logger"
 	csrf "github.com/gobuffalo/mw-csrf"
+	"github.com/gobuffalo/pop/v5"
 	"github.com/sirupsen/logrus"
 
 	// forcessl "github.com/gobuffalo/mw-forcessl"
@@ -81,8 +82,12 @@ func App() *buffalo.App {
 		// Wraps each request in a transaction.
 		//  c.Value("tx").(*pop.Connection)
 		// Remove to disable this.
-		app.Use(popmw.Transaction(models.DB))
+		transaction := popmw.Transaction(models.DB)
+		app.Use(transaction, poolConnection)
 		app.Use(models.BBoltTransaction(models.BDB))
+		// key/value storage on top of the bbolt or SQL transaction (KV_BACKEND)
+		//  c.Value("kv").(models.KV)
+		app.Use(models.KVTransaction)
 		// Setup and use translations:
 		app.Use(translations())
 		// -- Authorization/Security procedures --
@@ -128,10 +133,18 @@ func App() *buffalo.App {
 		admin.GET("users/{uid}/ban", BanUserGet).Name("banUser")
 		admin.GET("users/{uid}/admin", AdminUserGet).Name("adminUser")
 		admin.GET("users/{uid}/normalize", NormalizeUserGet).Name("normalizeUser")
+		admin.GET("users/{uid}/attempts", AttemptsUserGet).Name("userAttempts")
+		admin.GET("evaluations/{evalid}/attempts", AttemptsEvaluationGet).Name("evaluationAttempts")
+		admin.GET("gradebook", GradebookGet).Name("gradebook")
 
 		admin.GET("safelist", SafeListGet).Name("safeList")
 		admin.POST("safelist", SafeListPost)
 
+		admin.GET("runs", PyRunsGet).Name("pyRuns")
+		admin.POST("runs/{key}/delete", PyRunDelete).Name("pyRunDelete")
+		admin.GET("datasets", DatasetsGet).Name("datasets")
+		admin.POST("datasets", DatasetCreatePost)
+		admin.POST("datasets/{did}/delete", DatasetDelete).Name("datasetDelete")
 		admin.GET("/cbu", boltDBDownload(models.BDB)).Name("cursoCodeBackup")
 		admin.GET("/cbureader", zipAssetFolder("server/uploadReader")).Name("cursoCodeBackupReader")
 		adminForum := admin.Group("/f/{forum_title}")
@@ -140,11 +153,13 @@ func App() *buffalo.App {
 		// admin.GET("/exfiltrate", downloadSQL).Name("sqlBackup")
 		controlPanelGroup := admin.Group("/control-panel")
 		controlPanelGroup.GET("", ControlPanel).Name("controlPanel")
+		controlPanelGroup.GET("/py-pool", pyPoolStatsGet).Name("pyPoolStats")
 		controlPanelGroup.POST("/exfiltrate", generateJSONFromSQL).Name("sqlBackup")
 		controlPanelGroup.POST("/cbuDelete", DeletePythonUploads).Name("cursoCodeDelete")
+		controlPanelGroup.POST("/py-prune", PyRunsPrunePost).Name("pyRunsPrune")
 
 		controlPanelGroup.Use(ControlPanelHandler)
-		controlPanelGroup.Middleware.Skip(ControlPanelHandler, ControlPanel)
+		controlPanelGroup.Middleware.Skip(ControlPanelHandler, ControlPanel, pyPoolStatsGet, PyRunsPrunePost)
 
 		// All things curso de python
 		curso := app.Group("/curso-python")
@@ -155,9 +170,19 @@ func App() *buffalo.App {
 		curso.GET("/eval/e/{evalid}/edit", CursoEvaluationEditGet).Name("evaluationEditGet")
 		curso.POST("/eval/e/{evalid}/edit", CursoEvaluationEditPost)
 		curso.GET("/eval/e/{evalid}/delete", CursoEvaluationDelete).Name("evaluationDelete")
+		curso.GET("/datasets/{did}", DatasetDownload).Name("datasetDownload")
 
 		interpreter := app.Group("/py")
 		interpreter.POST("/", InterpretPost).Name("Interpret")
+		interpreter.POST("/stream", InterpretStreamPost).Name("interpretStream")
+		interpreter.GET("/stream/{sid}", InterpretStreamGet).Name("interpretStreamEvents")
+		interpreter.POST("/stream/{sid}/stdin", InterpretStreamStdinPost).Name("interpretStreamStdin")
+		// streams last as long as the python run so they don't hold a database connection
+		interpreter.Middleware.Skip(transaction, InterpretStreamGet)
+		interpreter.POST("/trace", InterpretTracePost).Name("interpretTrace")
+		interpreter.POST("/session", PySessionCellPost).Name("pySession")
+		interpreter.POST("/session/interrupt", PySessionInterruptPost).Name("pySessionInterrupt")
+		interpreter.POST("/session/restart", PySessionRestartPost).Name("pySessionRestart")
 
 		app.GET("/f", manageForum)
 		// Actual forum stuiff
@@ -225,6 +250,7 @@ func App() *buffalo.App {
 		app.ErrorHandlers[500] = err500
 
 		go runDBSearchIndex()
+		go runPyRunsPruner()
 		app.ServeFiles("/", assetsBox) // serve files from the public directory
 	}
 	return app
@@ -242,6 +268,18 @@ func translations() buffalo.MiddlewareFunc {
 	return T.Middleware()
 }
 
+// poolConnection sets the connection pool as "tx" of requests which skip
+// the transaction middleware so handlers and middleware can still query
+// the database. Each query borrows a connection from the pool.
+func poolConnection(next buffalo.Handler) buffalo.Handler {
+	return func(c buffalo.Context) error {
+		if _, ok := c.Value("tx").(*pop.Connection); !ok {
+			c.Set("tx", models.DB)
+		}
+		return next(c)
+	}
+}
+
 // forceSSL will return a middleware that will redirect an incoming request
 // if it is not HTTPS. "http://example.com" => "https://example.com".
 // This middleware does **not** enable SSL. for your application. To do that
@@ -0,0 +1,94 @@
+package actions
+
+import (
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// AttemptsEvaluationGet shows a summary of every student's attempts at an evaluation. For admins
+func AttemptsEvaluationGet(c buffalo.Context) error {
+	tx := c.Value("tx").(*pop.Connection)
+	eval := &models.Evaluation{}
+	if err := tx.Find(eval, c.Param("evalid")); err != nil {
+		return c.Error(404, err)
+	}
+	attempts := models.Attempts{}
+	err := tx.Select(models.AttemptSummaryColumns...).Where("evaluation_id = ?", eval.ID).Order("created_at ASC").All(&attempts)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := loadAttemptRelations(tx, attempts); err != nil {
+		return errors.WithStack(err)
+	}
+	c.Set("evaluation", eval)
+	c.Set("summaries", attempts.Summarize())
+	return c.Render(200, r.HTML("curso/attempts-eval.plush.html"))
+}
+
+// AttemptsUserGet shows all of a student's attempts grouped by evaluation. For admins
+func AttemptsUserGet(c buffalo.Context) error {
+	tx := c.Value("tx").(*pop.Connection)
+	user := &models.User{}
+	if err := tx.Find(user, c.Param("uid")); err != nil {
+		return c.Error(404, err)
+	}
+	attempts := models.Attempts{}
+	if err := tx.Where("user_id = ?", user.ID).Order("created_at ASC").All(&attempts); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := loadAttemptRelations(tx, attempts); err != nil {
+		return errors.WithStack(err)
+	}
+	c.Set("summaries", attempts.Summarize())
+	// most recent first
+	for i, j := 0, len(attempts)-1; i < j; i, j = i+1, j-1 {
+		attempts[i], attempts[j] = attempts[j], attempts[i]
+	}
+	c.Set("user", user)
+	c.Set("attempts", attempts)
+	return c.Render(200, r.HTML("curso/attempts-user.plush.html"))
+}
+
+// loadAttemptRelations sets User and Evaluation of attempts
+func loadAttemptRelations(tx *pop.Connection, attempts models.Attempts) error {
+	if len(attempts) == 0 {
+		return nil
+	}
+	userIDs := make(map[uuid.UUID]bool)
+	evalIDs := make(map[uuid.UUID]bool)
+	for _, a := range attempts {
+		userIDs[a.UserID], evalIDs[a.EvaluationID] = true, true
+	}
+	users := models.Users{}
+	if err := tx.Where("id in (?)", uuidKeys(userIDs)...).All(&users); err != nil {
+		return err
+	}
+	evals := models.Evaluations{}
+	if err := tx.Where("id in (?)", uuidKeys(evalIDs)...).All(&evals); err != nil {
+		return err
+	}
+	userMap := make(map[uuid.UUID]*models.User, len(users))
+	for i := range users {
+		userMap[users[i].ID] = &users[i]
+	}
+	evalMap := make(map[uuid.UUID]*models.Evaluation, len(evals))
+	for i := range evals {
+		evalMap[evals[i].ID] = &evals[i]
+	}
+	for i := range attempts {
+		attempts[i].User = userMap[attempts[i].UserID]
+		attempts[i].Evaluation = evalMap[attempts[i].EvaluationID]
+	}
+	return nil
+}
+
+func uuidKeys(m map[uuid.UUID]bool) []interface{} {
+	keys := make([]interface{}, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
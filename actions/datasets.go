@@ -0,0 +1,228 @@
+package actions
+
+// Datasets are data files uploaded by admins which python programs
+// can open by name, i.e. pandas.read_csv("notas.csv"). They are stored
+// in the database and cached read-only on disk, from where they are
+// placed in the working directory of every run: course datasets in all
+// runs and evaluation datasets in runs of their evaluation.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// datasetCacheDir is where dataset contents are cached so runs
+// do not read them from the database. See cachedDataset
+const datasetCacheDir = "tmp/datasets"
+
+// runDatasets returns paths of cached course datasets and datasets of
+// evaluation evalID by name. Evaluation datasets replace course
+// datasets of the same name. evalID may be uuid.Nil.
+func runDatasets(tx *pop.Connection, evalID uuid.UUID) (map[string]string, error) {
+	datasets := models.Datasets{}
+	err := tx.Select(models.DatasetColumns...).Where("evaluation_id IS NULL OR evaluation_id = ?", evalID).All(&datasets)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]models.Dataset, len(datasets))
+	for _, d := range datasets {
+		if _, ok := byName[d.Name]; !ok || d.EvaluationID.Valid {
+			byName[d.Name] = d
+		}
+	}
+	files := make(map[string]string, len(byName))
+	for name, d := range byName {
+		if files[name], err = cachedDataset(tx, d); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// cachedDataset returns the path of the read-only file with the contents
+// of dataset d, which need not be loaded. Files are named by ID and update
+// time so a new upload is never served from a stale file. The contents are
+// read from the database only if the file is missing or was tampered with.
+func cachedDataset(tx *pop.Connection, d models.Dataset) (string, error) {
+	dir, err := filepath.Abs(datasetCacheDir)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%s-%d", d.ID, d.UpdatedAt.UnixNano()))
+	if fi, err := os.Stat(name); err == nil && fi.Mode().Perm() == 0444 && fi.Size() == int64(d.Size) {
+		return name, nil
+	}
+	content := &models.Dataset{}
+	if err = tx.Select("content").Where("id = ?", d.ID).First(content); err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+		return "", err
+	}
+	// write to a temporary file and rename so concurrent runs never see a partial file
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(content.Content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0444)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	// files of previous uploads are not used again
+	removeCachedDataset(d.ID, name)
+	return name, nil
+}
+
+// removeCachedDataset deletes cached files of dataset id except keep
+func removeCachedDataset(id uuid.UUID, keep string) {
+	dir, err := filepath.Abs(datasetCacheDir)
+	if err != nil {
+		return
+	}
+	old, _ := filepath.Glob(filepath.Join(dir, id.String()+"-*"))
+	for _, name := range old {
+		if name != keep {
+			_ = os.Remove(name)
+		}
+	}
+}
+
+// evaluationDatasets lists datasets available to runs of evaluation evalID without their contents
+func evaluationDatasets(tx *pop.Connection, evalID uuid.UUID) (models.Datasets, error) {
+	datasets := models.Datasets{}
+	err := tx.Select(models.DatasetColumns...).Where("evaluation_id IS NULL OR evaluation_id = ?", evalID).
+		Order("name ASC").All(&datasets)
+	return datasets, err
+}
+
+// invalidateDatasetCache deletes cached solution outputs which may depend on dataset d
+func invalidateDatasetCache(kv models.KV, d *models.Dataset) error {
+	if d.EvaluationID.Valid {
+		return invalidateSolutionCache(kv, d.EvaluationID.UUID)
+	}
+	return kv.Clear(pyEvalCacheBucketName)
+}
+
+// DatasetsGet lists all datasets and the upload form. For admins
+func DatasetsGet(c buffalo.Context) error {
+	tx := c.Value("tx").(*pop.Connection)
+	datasets := models.Datasets{}
+	if err := tx.Select(models.DatasetColumns...).Order("name ASC").All(&datasets); err != nil {
+		return errors.WithStack(err)
+	}
+	evals := models.Evaluations{}
+	if err := tx.Where("deleted = ?", false).Order("created_at ASC").All(&evals); err != nil {
+		return errors.WithStack(err)
+	}
+	evalTitles := make(map[string]string, len(evals))
+	for _, e := range evals {
+		evalTitles[e.ID.String()] = deleteXMLTags(e.Title)
+	}
+	c.Set("datasets", datasets)
+	c.Set("evaluations", evals)
+	c.Set("eval_titles", evalTitles)
+	c.Set("max_size", models.DatasetMaxSize)
+	return c.Render(200, r.HTML("curso/datasets.plush.html"))
+}
+
+// DatasetCreatePost stores an uploaded dataset. The dataset is attached
+// to the evaluation in the evalid field or is a course dataset if empty. For admins
+func DatasetCreatePost(c buffalo.Context) error {
+	tx := c.Value("tx").(*pop.Connection)
+	d := &models.Dataset{}
+	if evalID := c.Param("evalid"); evalID != "" {
+		eval := &models.Evaluation{}
+		if err := tx.Where("id = ? AND deleted = ?", evalID, false).First(eval); err != nil {
+			return c.Error(404, err)
+		}
+		d.EvaluationID = nulls.NewUUID(eval.ID)
+	}
+	in, header, err := c.Request().FormFile("file")
+	if err != nil {
+		c.Flash().Add("danger", T.Translate(c, "curso-python-datasets-file-required"))
+		return c.Redirect(302, "datasetsPath()")
+	}
+	defer in.Close()
+	// read one byte past limit so validation catches large files
+	d.Content, err = ioutil.ReadAll(io.LimitReader(in, models.DatasetMaxSize+1))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	d.Name, d.Size = header.Filename, len(d.Content)
+	if name := c.Param("name"); name != "" {
+		d.Name = name
+	}
+	verrs, err := tx.ValidateAndCreate(d)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if verrs.HasAny() {
+		c.Flash().Add("danger", T.Translate(c, "curso-python-datasets-add-fail")+": "+verrs.Error())
+		return c.Redirect(302, "datasetsPath()")
+	}
+	if err = invalidateDatasetCache(c.Value("kv").(models.KV), d); err != nil {
+		return errors.WithStack(err)
+	}
+	c.Logger().Infof("dataset %s (%d bytes) uploaded by %s", d.Name, d.Size, c.Value("current_user").(*models.User).Email)
+	c.Flash().Add("success", T.Translate(c, "curso-python-datasets-add-success"))
+	return c.Redirect(302, "datasetsPath()")
+}
+
+// DatasetDelete deletes a dataset. For admins
+func DatasetDelete(c buffalo.Context) error {
+	tx := c.Value("tx").(*pop.Connection)
+	d := &models.Dataset{}
+	if err := tx.Select(models.DatasetColumns...).Where("id = ?", c.Param("did")).First(d); err != nil {
+		return c.Error(404, err)
+	}
+	if err := tx.Destroy(d); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := invalidateDatasetCache(c.Value("kv").(models.KV), d); err != nil {
+		return errors.WithStack(err)
+	}
+	removeCachedDataset(d.ID, "")
+	c.Flash().Add("success", T.Translate(c, "delete-success"))
+	return c.Redirect(302, "datasetsPath()")
+}
+
+// DatasetDownload sends a dataset to users who can see its evaluation
+func DatasetDownload(c buffalo.Context) error {
+	tx := c.Value("tx").(*pop.Connection)
+	user, ok := c.Value("current_user").(*models.User)
+	if !ok || user == nil {
+		return c.Error(403, fmt.Errorf("user not logged in"))
+	}
+	d := &models.Dataset{}
+	if err := tx.Where("id = ?", c.Param("did")).First(d); err != nil {
+		return c.Error(404, err)
+	}
+	if d.EvaluationID.Valid && user.Role != "admin" {
+		eval := &models.Evaluation{}
+		if err := tx.Where("id = ?", d.EvaluationID.UUID).First(eval); err != nil || eval.Hidden || eval.Deleted {
+			return c.Error(404, fmt.Errorf("dataset %s not found", d.ID))
+		}
+	}
+	return c.Render(200, r.Download(c, d.Name, bytes.NewReader(d.Content)))
+}
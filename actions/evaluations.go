@@ -3,11 +3,14 @@ package actions
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
 	"github.com/gobuffalo/buffalo"
 	"github.com/gobuffalo/buffalo/render"
+	"github.com/gobuffalo/nulls"
 	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -19,14 +22,24 @@ func EvaluationIndex(c buffalo.Context) error {
 		return c.Error(404, err)
 	}
 	// sort.Sort(evals)
+	datasets, err := evaluationDatasets(tx, uuid.Nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	c.Set("evaluations", evals)
+	c.Set("datasets", datasets)
+	if user, ok := c.Value("current_user").(*models.User); ok {
+		c.Set("locked", lockedEvaluations(*evals, user))
+	}
 	c.Logger().Debugf("Finishing EvaluationIndex with c.Data():%v", c.Data())
 	return c.Render(200, r.HTML("curso/eval-index.plush.html"))
 }
 
 // CursoEvaluationCreateGet renders evaluation creation page
 func CursoEvaluationCreateGet(c buffalo.Context) error {
-	c.Set("evaluation", models.Evaluation{})
+	setEvaluationDefaults(c)
+	c.Set("evaluation", models.Evaluation{PassThreshold: models.EvaluationDefaultPassThreshold,
+		LateMultiplier: models.EvaluationDefaultLateMultiplier})
 	return c.Render(200, r.HTML("curso/eval-create.plush.html"))
 }
 
@@ -37,19 +50,30 @@ func CursoEvaluationCreatePost(c buffalo.Context) error {
 	if err := c.Bind(eval); err != nil {
 		return errors.WithStack(err)
 	}
+	if err := bindEvaluationWindow(c, eval); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := bindEvaluationRequirements(c, eval); err != nil {
+		return errors.WithStack(err)
+	}
+	setEvaluationDefaults(c)
 	// Validate the data from the html form
 	verrs, err := tx.ValidateAndCreate(eval)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	c.Set("evaluation", eval)
+	c.Set("datasets", models.Datasets{})
 	if verrs.HasAny() {
-		c.Flash().Add("danger", T.Translate(c, "curso-python-evaluation-add-fail"))
-		return c.Render(422, r.HTML("topics/create.plush.html"))
+		c.Flash().Add("danger", T.Translate(c, "curso-python-evaluation-add-fail")+": "+verrs.Error())
+		return c.Render(422, r.HTML("curso/eval-create.plush.html"))
 	}
 	u := c.Value("current_user").(*models.User)
 	c.Logger().Infof("evaluation create %s, by %s", eval.Title, u.Email)
 	c.Flash().Add("success", T.Translate(c, "curso-python-evaluation-add-success"))
+	if err = cacheSolution(c, eval); err != nil {
+		c.Flash().Add("warning", T.Translate(c, "curso-python-evaluation-solution-error")+": "+err.Error())
+	}
 	return c.Render(200, r.HTML("curso/eval-get.plush.html"))
 }
 
@@ -62,6 +86,7 @@ func CursoEvaluationEditGet(c buffalo.Context) error {
 	if err := q.First(eval); err != nil {
 		return c.Error(404, err)
 	}
+	setEvaluationDefaults(c)
 	c.Set("evaluation", eval)
 	return c.Render(200, r.HTML("curso/eval-create.plush.html"))
 }
@@ -80,15 +105,110 @@ func CursoEvaluationEditPost(c buffalo.Context) error {
 	if err := c.Bind(eval); err != nil {
 		return errors.WithStack(err)
 	}
+	if err := bindEvaluationWindow(c, eval); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := bindEvaluationRequirements(c, eval); err != nil {
+		return errors.WithStack(err)
+	}
 	eval.ID = uid
 	// Validate the data from the html form
-	if err := tx.Update(eval); err != nil {
+	verrs, err := tx.ValidateAndUpdate(eval)
+	if err != nil {
 		return errors.WithStack(err)
 	}
+	if verrs.HasAny() {
+		setEvaluationDefaults(c)
+		c.Set("evaluation", eval)
+		c.Flash().Add("danger", T.Translate(c, "curso-python-evaluation-add-fail")+": "+verrs.Error())
+		return c.Render(422, r.HTML("curso/eval-create.plush.html"))
+	}
 	c.Flash().Add("success", T.Translate(c, "edit-success"))
+	if err = cacheSolution(c, eval); err != nil {
+		c.Flash().Add("warning", T.Translate(c, "curso-python-evaluation-solution-error")+": "+err.Error())
+	}
 	return c.Redirect(302, "evaluationGetPath()", render.Data{"evalid": eval.ID})
 }
 
+// setEvaluationDefaults sets interpreter defaults and evaluations
+// which may be prerequisites shown in evaluation form
+func setEvaluationDefaults(c buffalo.Context) {
+	c.Set("default_imports", defaultPyPolicy.safeList())
+	c.Set("default_source_length", defaultPyPolicy.MaxSourceLength)
+	c.Set("default_timeout", pyLimits.Timeout.String())
+	tx := c.Value("tx").(*pop.Connection)
+	evals := models.Evaluations{}
+	if err := tx.Where("deleted = ?", false).Order("created_at ASC").All(&evals); err != nil {
+		c.Logger().Errorf("listing prerequisite evaluations: %s", err)
+	}
+	c.Set("prerequisite_options", evals)
+}
+
+const (
+	// evaluationWindowLayout is the format of datetime-local inputs
+	evaluationWindowLayout = "2006-01-02T15:04"
+	// evaluationTimeLayout is the format of availability window times shown to users
+	evaluationTimeLayout = "2006-01-02 15:04"
+)
+
+// bindEvaluationWindow sets the availability window of eval from the
+// datetime-local inputs of the evaluation form which are in server time.
+// Empty inputs unset the time.
+func bindEvaluationWindow(c buffalo.Context, eval *models.Evaluation) error {
+	for name, t := range map[string]*nulls.Time{"opens_at": &eval.OpensAt,
+		"closes_at": &eval.ClosesAt, "late_until": &eval.LateUntil} {
+		v := strings.TrimSpace(c.Request().FormValue(name))
+		if v == "" {
+			*t = nulls.Time{}
+			continue
+		}
+		parsed, err := time.ParseInLocation(evaluationWindowLayout, v, time.Local)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %s", name, err)
+		}
+		*t = nulls.NewTime(parsed)
+	}
+	return nil
+}
+
+// bindEvaluationRequirements sets whether eval is final and its prerequisites
+// from the evaluation form. Unchecked checkboxes and empty selects are not
+// submitted so they can't be bound onto the stored evaluation.
+func bindEvaluationRequirements(c buffalo.Context, eval *models.Evaluation) error {
+	req := c.Request()
+	eval.Final = req.FormValue("final") == "true"
+	eval.Prerequisites = nil
+	for _, v := range req.Form["prerequisites"] {
+		id, err := uuid.FromString(v)
+		if err != nil {
+			return fmt.Errorf("parsing prerequisite: %s", err)
+		}
+		eval.Prerequisites = append(eval.Prerequisites, id)
+	}
+	return nil
+}
+
+// lockedEvaluations returns the titles of prerequisites user has
+// not passed by ID of the evaluations in evals they are missing for.
+func lockedEvaluations(evals models.Evaluations, user *models.User) map[string]string {
+	locked := make(map[string]string)
+	for _, e := range evals {
+		if missing := evals.MissingPrerequisites(e, user); len(missing) > 0 {
+			locked[e.ID.String()] = evaluationTitles(missing)
+		}
+	}
+	return locked
+}
+
+// evaluationTitles lists titles of evals without markup
+func evaluationTitles(evals models.Evaluations) string {
+	titles := make([]string, len(evals))
+	for i, e := range evals {
+		titles[i] = "\"" + deleteXMLTags(e.Title) + "\""
+	}
+	return strings.Join(titles, ", ")
+}
+
 // CursoEvaluationDelete handles deletion event of evaluation
 func CursoEvaluationDelete(c buffalo.Context) error {
 	tx := c.Value("tx").(*pop.Connection)
@@ -115,7 +235,21 @@ func CursoEvaluationGet(c buffalo.Context) error {
 	if err := q.First(eval); err != nil {
 		return c.Error(404, err)
 	}
+	datasets, err := evaluationDatasets(tx, eval.ID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	evals := models.Evaluations{}
+	if err = tx.Where("deleted = ?", false).All(&evals); err != nil {
+		return errors.WithStack(err)
+	}
+	var missing models.Evaluations
+	if user, ok := c.Value("current_user").(*models.User); ok {
+		missing = evals.MissingPrerequisites(*eval, user)
+	}
 	c.Set("evaluation", eval)
+	c.Set("datasets", datasets)
+	c.Set("missing_prerequisites", evaluationTitles(missing))
 	return c.Render(200, r.HTML("curso/eval-get.plush.html"))
 }
 
@@ -129,7 +263,7 @@ func PassedEvaluationHandler(next buffalo.Handler) buffalo.Handler {
 		user := c.Value("current_user").(*models.User)
 		c.Set("evaluations", evals)
 		for _, e := range *evals {
-			if strings.Contains(strings.ToLower(normalize(e.Title)), "desafio final") && !user.Subscribed(e.ID) {
+			if e.Final && !user.Subscribed(e.ID) {
 				c.Flash().Add("warning", T.Translate(c, "evaluation-pass-required", e))
 				c.Logger().Infof("user %s not passed. bounce back", user.Email)
 				return c.Redirect(302, c.Request().Referer())
@@ -149,7 +283,7 @@ func evaluationsPassed(c buffalo.Context, user *models.User) error {
 		return fmt.Errorf("Error checking evaluations")
 	}
 	for _, e := range *evals {
-		if strings.Contains(strings.ToLower(normalize(e.Title)), "desafio final") && !user.Subscribed(e.ID) {
+		if e.Final && !user.Subscribed(e.ID) {
 			e.Title = deleteXMLTags(e.Title)
 
 			return fmt.Errorf(T.Translate(c, "evaluation-pass-required", e))
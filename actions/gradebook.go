@@ -0,0 +1,200 @@
+package actions
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// gradebook has students as rows and evaluations as columns
+type gradebook struct {
+	Evaluations models.Evaluations
+	Rows        []gradebookRow
+}
+
+type gradebookRow struct {
+	User        models.User
+	TeamID      int // 0 if user has no team ID
+	Responsible string
+	Cells       []gradebookCell
+	Passed      int
+}
+
+type gradebookCell struct {
+	Passed    bool
+	BestScore float64
+	Attempts  int
+}
+
+// gradebookFilter selects which students are shown in gradebook. Empty fields do not filter
+type gradebookFilter struct {
+	Forum       string
+	Responsible string
+	TeamID      string
+}
+
+// forumMembersQuery selects users who posted topics or replies or answered a submission in a forum
+const forumMembersQuery = `id IN (
+SELECT t.author_id FROM topics t JOIN categories c ON t.category_id = c.id WHERE c.parent_category = ?
+UNION SELECT r.author_id FROM replies r JOIN topics t ON r.topic_id = t.id JOIN categories c ON t.category_id = c.id WHERE c.parent_category = ?
+UNION SELECT s.user_id FROM submissions s WHERE s.forum_id = ? AND NOT s.is_template)`
+
+// GradebookGet renders the gradebook. With format=csv or format=xlsx the
+// gradebook is downloaded as a file instead. For admins.
+func GradebookGet(c buffalo.Context) error {
+	tx := c.Value("tx").(*pop.Connection)
+	filter := gradebookFilter{Forum: c.Param("forum"), Responsible: c.Param("responsible"), TeamID: c.Param("team_id")}
+	if filter.Forum != "" {
+		if _, err := uuid.FromString(filter.Forum); err != nil {
+			return c.Error(400, err)
+		}
+	}
+	responsibles, err := safeListResponsibles(c.Value("kv").(models.KV))
+	if err != nil {
+		return c.Error(500, err)
+	}
+	g, err := newGradebook(tx, filter, responsibles)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	filename := "gradebook-" + time.Now().Format("2006-01-02")
+	switch c.Param("format") {
+	case "csv":
+		c.Response().Header().Set("Content-Type", "text/csv; charset=utf-8")
+		c.Response().Header().Set("Content-Disposition", "attachment; filename="+filename+".csv")
+		w := csv.NewWriter(c.Response())
+		if err = w.WriteAll(g.table()); err != nil {
+			return errors.WithStack(err)
+		}
+		return nil
+	case "xlsx":
+		c.Response().Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		c.Response().Header().Set("Content-Disposition", "attachment; filename="+filename+".xlsx")
+		return errors.WithStack(writeXLSX(c.Response(), "gradebook", g.table()))
+	}
+	forums := models.Forums{}
+	if err = tx.Order("title ASC").All(&forums); err != nil {
+		return errors.WithStack(err)
+	}
+	c.Set("gradebook", g)
+	c.Set("filter", filter)
+	c.Set("forums", forums)
+	c.Set("responsibles", distinctValues(responsibles))
+	return c.Render(200, r.HTML("curso/gradebook.plush.html"))
+}
+
+func newGradebook(tx *pop.Connection, filter gradebookFilter, responsibles map[string]string) (*gradebook, error) {
+	g := &gradebook{}
+	if err := tx.Where("deleted = ?", false).Order("created_at ASC").All(&g.Evaluations); err != nil {
+		return nil, err
+	}
+	users := models.Users{}
+	q := tx.Where("role != ?", "admin").Order("name ASC")
+	if filter.Forum != "" {
+		q = q.Where(forumMembersQuery, filter.Forum, filter.Forum, filter.Forum)
+	}
+	if err := q.All(&users); err != nil {
+		return nil, err
+	}
+	attempts := models.Attempts{}
+	if err := tx.Select(models.AttemptSummaryColumns...).Order("created_at ASC").All(&attempts); err != nil {
+		return nil, err
+	}
+	type key struct{ user, eval uuid.UUID }
+	summaries := make(map[key]models.AttemptSummary)
+	for _, s := range attempts.Summarize() {
+		summaries[key{s.UserID, s.EvaluationID}] = s
+	}
+	for _, u := range users {
+		row := gradebookRow{User: u, TeamID: teamIDs[u.Email], Responsible: responsibles[strings.ToLower(u.Email)]}
+		if filter.Responsible != "" && row.Responsible != filter.Responsible {
+			continue
+		}
+		if filter.TeamID != "" && strconv.Itoa(row.TeamID) != filter.TeamID {
+			continue
+		}
+		for _, e := range g.Evaluations {
+			s := summaries[key{u.ID, e.ID}]
+			// users who passed before attempts were stored only have a subscription
+			cell := gradebookCell{Passed: u.Subscribed(e.ID) || s.AttemptsToPass > 0, BestScore: s.BestScore, Attempts: s.Attempts}
+			if cell.Passed {
+				row.Passed++
+			}
+			row.Cells = append(row.Cells, cell)
+		}
+		g.Rows = append(g.Rows, row)
+	}
+	return g, nil
+}
+
+// table returns gradebook as rows of cells with a header.
+// Each evaluation takes up three columns: passed, best score and attempts
+func (g *gradebook) table() [][]string {
+	header := []string{"name", "nick", "email", "team_id", "responsible", "passed"}
+	for _, e := range g.Evaluations {
+		title := spreadsheetText(deleteXMLTags(e.Title))
+		header = append(header, title+" passed", title+" score", title+" attempts")
+	}
+	table := [][]string{header}
+	for _, row := range g.Rows {
+		teamID := ""
+		if row.TeamID != 0 {
+			teamID = strconv.Itoa(row.TeamID)
+		}
+		record := []string{spreadsheetText(row.User.Name), spreadsheetText(row.User.Nick), spreadsheetText(row.User.Email),
+			teamID, spreadsheetText(row.Responsible), strconv.Itoa(row.Passed)}
+		for _, cell := range row.Cells {
+			record = append(record, strconv.FormatBool(cell.Passed), fmt.Sprintf("%.2f", cell.BestScore), strconv.Itoa(cell.Attempts))
+		}
+		table = append(table, record)
+	}
+	return table
+}
+
+// spreadsheetText prefixes text starting like a formula with a quote
+// so spreadsheet programs show it as text instead of evaluating it
+func spreadsheetText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// safeListResponsibles maps emails in safelist to the
+// name of the admin who added them
+func safeListResponsibles(kv models.KV) (map[string]string, error) {
+	responsibles := make(map[string]string)
+	err := kv.ForEach(safeUsersBucketName, nil, func(_, v []byte) error {
+		var user safeUser
+		if err := json.Unmarshal(v, &user); err != nil {
+			return err
+		}
+		responsibles[user.Email] = user.Responsible
+		return nil
+	})
+	return responsibles, err
+}
+
+// distinctValues returns sorted distinct values of m
+func distinctValues(m map[string]string) []string {
+	set := make(map[string]bool)
+	for _, v := range m {
+		set[v] = true
+	}
+	values := make([]string, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
@@ -0,0 +1,32 @@
+package actions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+)
+
+func TestGradebookTable(t *testing.T) {
+	g := &gradebook{
+		Evaluations: models.Evaluations{{Title: "=1+1"}},
+		Rows: []gradebookRow{{
+			User:        models.User{Name: "=HYPERLINK(\"http://x\")", Nick: "@nick", Email: "-a@b.c"},
+			TeamID:      12,
+			Responsible: "+Ana",
+			Cells:       []gradebookCell{{Passed: true, BestScore: 0.5, Attempts: 2}},
+			Passed:      1,
+		}, {
+			User:  models.User{Name: "Juan", Nick: "juan", Email: "juan@b.c"},
+			Cells: []gradebookCell{{}},
+		}},
+	}
+	want := [][]string{
+		{"name", "nick", "email", "team_id", "responsible", "passed", "'=1+1 passed", "'=1+1 score", "'=1+1 attempts"},
+		{"'=HYPERLINK(\"http://x\")", "'@nick", "'-a@b.c", "12", "'+Ana", "1", "true", "0.50", "2"},
+		{"Juan", "juan", "juan@b.c", "", "", "0", "false", "0.00", "0"},
+	}
+	if got := g.table(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got table\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,188 @@
+package actions
+
+// Comparison of a student's output with a test case's expected output.
+// See models.ParseComparator for the available comparators.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+)
+
+// pyMaxDiffLines is the max amount of differing lines shown to students
+const pyMaxDiffLines = 12
+
+// compareOutput reports whether p.Output passes test case tc given the expected
+// output. fromSolution is true when expected is the output of the evaluation's solution.
+// feedback is a diff or the checker's complaint and is meant for visible test cases.
+// A non-nil error means the comparison could not be done.
+func (p *pythonHandler) compareOutput(eval *models.Evaluation, tc models.TestCase, expected string, fromSolution bool) (ok bool, feedback string, err error) {
+	cmp, err := eval.CaseComparator(tc)
+	if err != nil {
+		return false, "", err
+	}
+	actual := p.Output
+	switch cmp.Mode {
+	case models.CompareExact:
+		ok = actual == expected
+	case models.CompareWhitespace:
+		ok = equalFields(strings.Fields(actual), strings.Fields(expected), func(a, b string) bool { return a == b })
+	case models.CompareUnordered:
+		ok = equalFields(sortedLines(actual), sortedLines(expected), func(a, b string) bool { return a == b })
+	case models.CompareFloat:
+		ok = equalFields(strings.Fields(actual), strings.Fields(expected), func(a, b string) bool {
+			return a == b || floatsClose(a, b, cmp.Abs, cmp.Rel)
+		})
+	case models.CompareRegex:
+		pattern := strings.TrimSuffix(expected, "\n")
+		if fromSolution {
+			pattern = regexp.QuoteMeta(pattern)
+		}
+		re, err := regexp.Compile("^(?s:" + pattern + ")$")
+		if err != nil {
+			return false, "", fmt.Errorf("test case %s: %s", tc.Name, err)
+		}
+		return re.MatchString(strings.TrimSuffix(actual, "\n")), "", nil
+	case models.CompareChecker:
+		return p.runChecker(eval, tc.Stdin, expected, actual)
+	}
+	if !ok {
+		feedback = lineDiff(expected, actual)
+	}
+	return ok, feedback, nil
+}
+
+func equalFields(a, b []string, eq func(a, b string) bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !eq(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedLines returns lines of s sorted without trailing whitespace or empty lines
+func sortedLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimRight(line, " \t"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// floatsClose reports whether a and b are numbers which differ
+// by less than abs or by less than rel relative to b
+func floatsClose(a, b string, abs, rel float64) bool {
+	x, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return false
+	}
+	diff := math.Abs(x - y)
+	return diff <= abs || diff <= rel*math.Abs(y)
+}
+
+// runChecker runs the evaluation's checker in the sandbox. The checker
+// gets a JSON object with input, expected and actual keys through stdin
+// (read it with json.loads(input())) and fails the test case by raising an
+// exception, i.e. with assert. The exception message is returned as feedback.
+func (p *pythonHandler) runChecker(eval *models.Evaluation, input, expected, actual string) (ok bool, feedback string, err error) {
+	stdin, err := json.Marshal(map[string]string{"input": input, "expected": expected, "actual": actual})
+	if err != nil {
+		return false, "", err
+	}
+	limits := pyLimits
+	if p.limits != nil {
+		limits = *p.limits
+	}
+	res, err := pyWorkers.Run(pyRunner, &RunJob{
+		Source:   eval.Checker.String,
+		Input:    string(stdin),
+		UserName: p.UserName,
+		UserID:   p.userID,
+		Limits:   limits,
+		Datasets: p.datasets,
+	})
+	if busy, isBusy := err.(*pyBusyError); isBusy {
+		return false, "", busy
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("server error running checker: %s", err)
+	}
+	switch {
+	case res.Status == pyTimeout || res.Limit != "":
+		return false, "", fmt.Errorf("checker exceeded %s limit", res.Limit)
+	case res.Status == pyError:
+		lines := strings.Split(strings.TrimSpace(res.Output), "\n")
+		return false, lines[len(lines)-1], nil
+	}
+	return true, "", nil
+}
+
+// lineDiff returns the lines which differ between expected and actual
+// prefixed by - and + respectively.
+func lineDiff(expected, actual string) string {
+	a := strings.Split(strings.TrimSuffix(expected, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(actual, "\n"), "\n")
+	const maxLines = 200 // keeps the LCS table small
+	if len(a) > maxLines {
+		a = a[:maxLines]
+	}
+	if len(b) > maxLines {
+		b = b[:maxLines]
+	}
+	// lcs[i][j] is length of longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+			continue
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	if len(diff) == 0 { // outputs differ only in trailing newline or whitespace
+		return "- " + strconv.Quote(expected) + "\n+ " + strconv.Quote(actual)
+	}
+	if len(diff) > pyMaxDiffLines {
+		diff = append(diff[:pyMaxDiffLines], "...")
+	}
+	return strings.Join(diff, "\n")
+}
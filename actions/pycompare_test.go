@@ -0,0 +1,89 @@
+package actions
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+)
+
+func TestCompareOutput(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		comparator       string
+		expected, actual string
+		fromSolution     bool
+		ok, err          bool
+		onCase           bool
+	}{
+		{name: "exact", expected: "1 2\n", actual: "1 2\n", ok: true},
+		{name: "exact trailing newline", expected: "1 2\n", actual: "1 2"},
+		{name: "exact spaces", comparator: "exact", expected: "1 2\n", actual: "1  2\n"},
+		{name: "whitespace", comparator: "whitespace", expected: "1 2\n3\n", actual: " 1  2 3", ok: true},
+		{name: "whitespace differs", comparator: "whitespace", expected: "1 2\n", actual: "1 3\n"},
+		{name: "mode name is case insensitive", comparator: "WhiteSpace", expected: "a b", actual: "a\tb\n", ok: true},
+		{name: "whitespace output is case sensitive", comparator: "whitespace", expected: "Hola", actual: "hola"},
+		{name: "unordered", comparator: "unordered", expected: "a\nb\n", actual: "b \na\n\n", ok: true},
+		{name: "unordered counts lines", comparator: "unordered", expected: "a\na\nb\n", actual: "a\nb\nb\n"},
+		{name: "float default tolerance", comparator: "float", expected: "3.14159\n", actual: "3.1415901\n", ok: true},
+		{name: "float differs", comparator: "float", expected: "0.1 0.2\n", actual: "0.1 0.3\n"},
+		{name: "float words", comparator: "float", expected: "x = 1.0\n", actual: "x = 1\n", ok: true},
+		{name: "float words differ", comparator: "float", expected: "abc 1\n", actual: "abd 1\n"},
+		{name: "float abs", comparator: "float:abs=1e-2", expected: "1.00\n", actual: "1.005\n", ok: true},
+		{name: "float rel", comparator: "float:abs=0,rel=0.1", expected: "100\n", actual: "109\n", ok: true},
+		{name: "float rel exceeded", comparator: "float:abs=0,rel=0.1", expected: "100\n", actual: "111\n"},
+		{name: "float rel of expected", comparator: "float:abs=0,rel=0.1", expected: "-100\n", actual: "-90\n", ok: true},
+		{name: "float field count", comparator: "float", expected: "1 2\n", actual: "1\n"},
+		{name: "regex", comparator: "regex", expected: `\d+` + "\n", actual: "42\n", ok: true},
+		{name: "regex matches all output", comparator: "regex", expected: `\d+`, actual: "42a\n"},
+		{name: "regex multiline", comparator: "regex", expected: `a.*c`, actual: "a\nb\nc\n", ok: true},
+		{name: "regex from solution is literal", comparator: "regex", expected: "1+1\n", actual: "1+1\n", fromSolution: true, ok: true},
+		{name: "invalid regex", comparator: "regex", expected: "(", actual: "(", err: true},
+		{name: "unknown comparator", comparator: "fuzzy", expected: "a", actual: "a", err: true},
+		{name: "options of exact", comparator: "exact:abs=1", expected: "a", actual: "a", err: true},
+		{name: "negative tolerance", comparator: "float:abs=-1", expected: "1", actual: "1", err: true},
+		{name: "case comparator", comparator: "whitespace", expected: "1 2", actual: "1  2", ok: true, onCase: true},
+	} {
+		eval := &models.Evaluation{Comparator: test.comparator}
+		tc := models.TestCase{Name: "1"}
+		if test.onCase {
+			eval.Comparator, tc.Comparator = "exact", test.comparator
+		}
+		p := &pythonHandler{}
+		p.Output = test.actual
+		ok, feedback, err := p.compareOutput(eval, tc, test.expected, test.fromSolution)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("%s: got ok %v, want %v", test.name, ok, test.ok)
+		}
+		if !ok && !test.err && test.comparator != "regex" && feedback == "" {
+			t.Errorf("%s: no diff for failed comparison", test.name)
+		}
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	var expected, actual []string
+	for i := 0; i < 20; i++ {
+		expected, actual = append(expected, "a"), append(actual, "b")
+	}
+	for _, test := range []struct {
+		name, expected, actual, diff string
+	}{
+		{name: "changed line", expected: "a\nb\nc\n", actual: "a\nx\nc\n", diff: "- b\n+ x"},
+		{name: "missing line", expected: "a\nb\nc\n", actual: "a\nc\n", diff: "- b"},
+		{name: "extra line", expected: "a\nc\n", actual: "a\nb\nc\n", diff: "+ b"},
+		{name: "empty output", expected: "a\nb\n", actual: "", diff: "- a\n- b\n+ "},
+		{name: "trailing newline", expected: "a\n", actual: "a", diff: "- \"a\\n\"\n+ \"a\""},
+		{name: "trailing newlines", expected: "a\n", actual: "a\n\n", diff: "+ "},
+		{name: "truncated", expected: strings.Join(expected, "\n"), actual: strings.Join(actual, "\n"),
+			diff: strings.Repeat("- a\n", pyMaxDiffLines) + "..."},
+	} {
+		if diff := lineDiff(test.expected, test.actual); diff != test.diff {
+			t.Errorf("%s: got diff\n%s\nwant\n%s", test.name, diff, test.diff)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package actions
+
+// Matplotlib figures created by python runs. Every run's working
+// directory has a sitecustomize.py which python imports at startup
+// (the working directory is in PYTHONPATH). It selects a non-interactive
+// backend and saves figures still open at exit to pyFigureDir. Figures
+// are sent to the user next to the output. Saving figures from user
+// code is forbidden by the sanitizer.
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/envy"
+)
+
+const pyFigureDir = "__figures__"
+
+// Set in init()
+var (
+	pyFigureFormat string
+	// pyFigureTimeout is the minimum wall and CPU time of runs which may draw figures. See figureLimits
+	pyFigureTimeout time.Duration
+)
+
+func init() {
+	pyFigureFormat = envy.Get("PY_FIGURE_FORMAT", "png")
+	if pyFigureFormat != "png" && pyFigureFormat != "svg" {
+		must(fmt.Errorf("PY_FIGURE_FORMAT must be png or svg. got %q", pyFigureFormat))
+	}
+	var err error
+	pyFigureTimeout, err = time.ParseDuration(envy.Get("PY_FIGURE_TIMEOUT", "3s"))
+	must(err)
+}
+
+// figureLimits returns limits of a run of source. Importing matplotlib
+// alone takes longer than the default timeout so runs which may draw
+// figures, importing matplotlib or pandas (plot methods), get at least pyFigureTimeout.
+func figureLimits(source string, limits *RunLimits) *RunLimits {
+	if imports := pyImports(source); !imports["matplotlib"] && !imports["pandas"] {
+		return limits
+	}
+	l := *limits
+	if l.Timeout < pyFigureTimeout {
+		l.Timeout = pyFigureTimeout
+	}
+	// zero CPU time is no limit
+	if l.CPUTime != 0 && l.CPUTime < pyFigureTimeout {
+		l.CPUTime = pyFigureTimeout
+	}
+	return &l
+}
+
+// pyFigure is an image created by a python run
+type pyFigure struct {
+	// Format is png or svg
+	Format string `json:"format"`
+	// Data is the base64 encoded image
+	Data string `json:"data"`
+}
+
+const pySiteCustomize = `# Imported by python before running user code.
+# Figures open at exit are saved so they are shown to the user.
+import atexit
+import os
+import sys
+import warnings
+
+os.environ.setdefault("MPLBACKEND", "Agg")
+warnings.filterwarnings("ignore", message=".*non-GUI backend.*")
+
+
+def _save_figures():
+    plt = sys.modules.get("matplotlib.pyplot")
+    if plt is None:
+        return
+    os.makedirs("{dir}", exist_ok=True)
+    for i, num in enumerate(plt.get_fignums()[:{max}]):
+        plt.figure(num).savefig(os.path.join("{dir}", "%d.{format}" % i), format="{format}")
+
+
+atexit.register(_save_figures)
+`
+
+// siteCustomize returns the sitecustomize.py which saves at most limits.MaxFigures figures
+func siteCustomize(limits RunLimits) string {
+	return strings.NewReplacer("{dir}", pyFigureDir, "{max}", strconv.Itoa(limits.MaxFigures),
+		"{format}", pyFigureFormat).Replace(pySiteCustomize)
+}
+
+// collectFigures reads figures saved in a run's working directory dir.
+// Figures larger than limits.MaxFigureSize are dropped and counted.
+func collectFigures(dir string, limits RunLimits) (figures []pyFigure, dropped int, err error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, pyFigureDir))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		ni, _ := strconv.Atoi(strings.TrimSuffix(files[i].Name(), filepath.Ext(files[i].Name())))
+		nj, _ := strconv.Atoi(strings.TrimSuffix(files[j].Name(), filepath.Ext(files[j].Name())))
+		return ni < nj
+	})
+	for _, f := range files {
+		if len(figures) == limits.MaxFigures {
+			break
+		}
+		format := strings.TrimPrefix(filepath.Ext(f.Name()), ".")
+		if !f.Mode().IsRegular() || (format != "png" && format != "svg") {
+			continue
+		}
+		if limits.MaxFigureSize > 0 && f.Size() > int64(limits.MaxFigureSize) {
+			dropped++
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, pyFigureDir, f.Name()))
+		if err != nil {
+			return figures, dropped, err
+		}
+		figures = append(figures, pyFigure{Format: format, Data: base64.StdEncoding.EncodeToString(b)})
+	}
+	return figures, dropped, nil
+}
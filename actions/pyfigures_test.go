@@ -0,0 +1,36 @@
+package actions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFigureLimits(t *testing.T) {
+	limits := &RunLimits{Timeout: 500 * time.Millisecond, CPUTime: time.Second}
+	for _, test := range []struct {
+		name, src string
+		raised    bool
+	}{
+		{name: "no imports", src: "print(1)\n"},
+		{name: "import", src: "import matplotlib.pyplot as plt\n", raised: true},
+		{name: "from import", src: "from matplotlib import pyplot\n", raised: true},
+		{name: "import list", src: "import math, pandas as pd\n", raised: true},
+		{name: "import after semicolon", src: "x = 1; import pandas\n", raised: true},
+		{name: "comment", src: "# import matplotlib\nprint(1)\n"},
+		{name: "string", src: "print('import pandas')\n"},
+		{name: "attribute", src: "import math\nmath.matplotlib = 1\n"},
+		{name: "other module", src: "import numpy, math\nfrom math import pi\n"},
+	} {
+		got := figureLimits(test.src, limits)
+		if raised := got.Timeout != limits.Timeout; raised != test.raised {
+			t.Errorf("%s: got timeout %s", test.name, got.Timeout)
+		}
+		if test.raised && (got.Timeout < pyFigureTimeout || got.CPUTime < pyFigureTimeout) {
+			t.Errorf("%s: got limits %s and %s, want at least %s", test.name, got.Timeout, got.CPUTime, pyFigureTimeout)
+		}
+	}
+	long := &RunLimits{Timeout: time.Minute}
+	if got := figureLimits("import pandas\n", long); got.Timeout != time.Minute || got.CPUTime != 0 {
+		t.Errorf("lowered or set limits: got %s and %s", got.Timeout, got.CPUTime)
+	}
+}
@@ -0,0 +1,527 @@
+package actions
+
+// Static checks of user code similar to pyflakes, run before code is
+// executed. There is no python parser in Go so checks work on tokens
+// and are conservative: a name bound anywhere in the program counts as
+// defined everywhere, so only names that are never bound are reported.
+// Code python would refuse to compile stops the run, other findings are
+// returned as warnings next to the output.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// pyWarning is a finding of the static checks which does not stop the run
+type pyWarning struct {
+	Line int    `json:"line"`
+	Col  int    `json:"col"`
+	Msg  string `json:"msg"`
+}
+
+var pyKeywords = setOf("False", "None", "True", "and", "as", "assert", "async", "await", "break", "class",
+	"continue", "def", "del", "elif", "else", "except", "finally", "for", "from", "global", "if", "import",
+	"in", "is", "lambda", "nonlocal", "not", "or", "pass", "raise", "return", "try", "while", "with", "yield")
+
+// pyCompoundKeywords start statements which have a block
+var pyCompoundKeywords = setOf("if", "elif", "else", "for", "while", "def", "class", "try", "except",
+	"finally", "with")
+
+var pyAugmentedAssign = setOf("+=", "-=", "*=", "/=", "//=", "%=", "**=", "@=", "&=", "|=", "^=", ">>=", "<<=")
+
+var pyBuiltins = setOf("abs", "aiter", "all", "anext", "any", "ascii", "bin", "bool", "breakpoint", "bytearray",
+	"bytes", "callable", "chr", "classmethod", "compile", "complex", "copyright", "credits", "delattr", "dict",
+	"dir", "divmod", "enumerate", "eval", "exec", "exit", "filter", "float", "format", "frozenset", "getattr",
+	"globals", "hasattr", "hash", "help", "hex", "id", "input", "int", "isinstance", "issubclass", "iter", "len",
+	"license", "list", "locals", "map", "max", "memoryview", "min", "next", "object", "oct", "open", "ord", "pow",
+	"print", "property", "quit", "range", "repr", "reversed", "round", "set", "setattr", "slice", "sorted",
+	"staticmethod", "str", "sum", "super", "tuple", "type", "vars", "zip", "Ellipsis", "NotImplemented",
+	"__name__", "__doc__", "__file__", "__builtins__", "__spec__", "__loader__", "__package__", "__debug__",
+	"__import__", "__build_class__",
+	// exceptions
+	"BaseException", "Exception", "ArithmeticError", "AssertionError", "AttributeError", "BlockingIOError",
+	"BrokenPipeError", "BufferError", "BytesWarning", "ChildProcessError", "ConnectionAbortedError",
+	"ConnectionError", "ConnectionRefusedError", "ConnectionResetError", "DeprecationWarning", "EOFError",
+	"EnvironmentError", "FileExistsError", "FileNotFoundError", "FloatingPointError", "FutureWarning",
+	"GeneratorExit", "IOError", "ImportError", "ImportWarning", "IndentationError", "IndexError",
+	"InterruptedError", "IsADirectoryError", "KeyError", "KeyboardInterrupt", "LookupError", "MemoryError",
+	"ModuleNotFoundError", "NameError", "NotADirectoryError", "NotImplementedError", "OSError", "OverflowError",
+	"PendingDeprecationWarning", "PermissionError", "ProcessLookupError", "RecursionError", "ReferenceError",
+	"ResourceWarning", "RuntimeError", "RuntimeWarning", "StopAsyncIteration", "StopIteration", "SyntaxError",
+	"SyntaxWarning", "SystemError", "SystemExit", "TabError", "TimeoutError", "TypeError", "UnboundLocalError",
+	"UnicodeDecodeError", "UnicodeEncodeError", "UnicodeError", "UnicodeTranslateError", "UnicodeWarning",
+	"UserWarning", "ValueError", "Warning", "ZeroDivisionError")
+
+// lintPy checks python source. Errors are returned for code python
+// would not compile, i.e. return outside of a function.
+func lintPy(src string) ([]pyWarning, error) {
+	toks, err := tokenizePy(src)
+	if err != nil {
+		return nil, err
+	}
+	l := &pyLinter{toks: toks, binds: map[int]bool{}, skips: map[int]bool{}, terminated: -1}
+	if err = l.scan(); err != nil {
+		return nil, err
+	}
+	l.expressions()
+	l.names()
+	sort.SliceStable(l.warnings, func(i, j int) bool {
+		a, b := l.warnings[i], l.warnings[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+	})
+	return l.warnings, nil
+}
+
+type pyLinter struct {
+	toks []pyToken
+	// binds are indices of names which are bound by their statement
+	binds map[int]bool
+	// skips are indices of names which neither bind nor use a variable, i.e. keyword arguments
+	skips map[int]bool
+	// imports are indices of names bound by import statements
+	imports []int
+	// blocks are keywords of the compound statements enclosing the current statement
+	blocks []string
+	// header is the keyword of the last compound statement. Its block starts at the next INDENT
+	header string
+	// inline is the keyword of a compound statement with its body on the current line, i.e. `if x: break`
+	inline string
+	// terminated is the block depth of the last return, raise, break or continue. -1 if none
+	terminated int
+	warnings   []pyWarning
+}
+
+func (l *pyLinter) warn(tok pyToken, format string, a ...interface{}) {
+	l.warnings = append(l.warnings, pyWarning{Line: tok.Line, Col: tok.Col, Msg: fmt.Sprintf(format, a...)})
+}
+
+// isName reports whether toks[i] is a variable name: not a keyword nor an attribute
+func (l *pyLinter) isName(i int) bool {
+	return l.toks[i].Kind == pyName && !pyKeywords[l.toks[i].Value] && !(i > 0 && l.toks[i-1].is(pyOp, "."))
+}
+
+// scan walks statements keeping track of the blocks they are in
+func (l *pyLinter) scan() (err error) {
+	for i := 0; i < len(l.toks); {
+		tok := l.toks[i]
+		switch tok.Kind {
+		case pyIndent:
+			l.blocks = append(l.blocks, l.header)
+			i++
+			continue
+		case pyDedent:
+			if len(l.blocks) > 0 {
+				l.blocks = l.blocks[:len(l.blocks)-1]
+			}
+			l.terminated = -1
+			i++
+			continue
+		case pyNewline:
+			l.inline = ""
+			i++
+			continue
+		}
+		if l.terminated == len(l.blocks) && l.inline == "" && l.toks[i-1].Kind != pyOp {
+			l.warn(tok, "unreachable code")
+			l.terminated = -1
+		}
+		if i, err = l.statement(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statement checks the statement starting at toks[s] and returns
+// the index of the token following it
+func (l *pyLinter) statement(s int) (int, error) {
+	toks := l.toks
+	kw := toks[s].Value
+	if toks[s].is(pyName, "async") && s+1 < len(toks) {
+		kw = toks[s+1].Value
+	}
+	if toks[s].Kind == pyName && (pyCompoundKeywords[kw] || l.softKeyword(s)) {
+		h := l.headerEnd(s)
+		if h > 0 {
+			l.compound(kw, s, h)
+			if h+1 >= len(toks) || toks[h+1].Kind == pyNewline {
+				l.header = kw
+			} else {
+				l.inline = kw
+			}
+			return h + 1, nil
+		}
+		if pyCompoundKeywords[kw] {
+			e := s
+			for e+1 < len(toks) && toks[e+1].Kind != pyNewline {
+				e++
+			}
+			return e, toks[e].errorf("expected ':'")
+		}
+	}
+	e := s
+	for e < len(toks) && toks[e].Kind != pyNewline && !toks[e].is(pyOp, ";") {
+		e++
+	}
+	err := l.simple(s, e)
+	if e < len(toks) && toks[e].is(pyOp, ";") {
+		e++
+	}
+	return e, err
+}
+
+// softKeyword reports whether toks[s] starts a match statement or case clause
+func (l *pyLinter) softKeyword(s int) bool {
+	if !l.toks[s].is(pyName, "match") && !l.toks[s].is(pyName, "case") || s+1 >= len(l.toks) {
+		return false
+	}
+	next := l.toks[s+1]
+	return next.Kind != pyOp && next.Kind != pyNewline || isOpenBracket(next) || next.is(pyOp, "-")
+}
+
+// headerEnd returns the index of the colon ending the compound
+// statement header starting at toks[s], -1 if there is none
+func (l *pyLinter) headerEnd(s int) int {
+	depth, lambdas := 0, 0
+	for i := s; i < len(l.toks) && l.toks[i].Kind != pyNewline; i++ {
+		tok := l.toks[i]
+		switch {
+		case tok.is(pyName, "lambda") && depth == 0:
+			lambdas++
+		case isOpenBracket(tok):
+			depth++
+		case isCloseBracket(tok):
+			depth--
+		case tok.is(pyOp, ":") && depth == 0:
+			if lambdas == 0 {
+				return i
+			}
+			lambdas--
+		}
+	}
+	return -1
+}
+
+// lambdaEnd returns the index of the colon ending lambda parameters starting at toks[s]
+func (l *pyLinter) lambdaEnd(s int) int {
+	depth := 0
+	for i := s; i < len(l.toks) && l.toks[i].Kind != pyNewline; i++ {
+		tok := l.toks[i]
+		switch {
+		case isOpenBracket(tok):
+			depth++
+		case isCloseBracket(tok):
+			depth--
+		case tok.is(pyOp, ":") && depth == 0:
+			return i
+		}
+	}
+	return s
+}
+
+// compound marks names bound by the header toks[s:h] of a compound statement.
+// for targets and as aliases are marked by expressions.
+func (l *pyLinter) compound(kw string, s, h int) {
+	toks := l.toks
+	switch kw {
+	case "def", "class":
+		i := s + 1
+		if toks[s].is(pyName, "async") {
+			i++
+		}
+		if i < h && l.isName(i) {
+			l.binds[i] = true
+		}
+		if kw == "def" {
+			l.params(i+1, h, 1)
+		}
+	case "match":
+		l.skips[s] = true
+	case "case":
+		l.skips[s] = true
+		// capture patterns bind names, class patterns and dotted values use them
+		for i := s + 1; i < h && !toks[i].is(pyName, "if"); i++ {
+			if l.isName(i) && !toks[i+1].is(pyOp, "(") && !toks[i+1].is(pyOp, ".") {
+				l.binds[i] = true
+			}
+		}
+	}
+}
+
+// params marks parameter names in toks[s:e] found at bracket depth depth
+func (l *pyLinter) params(s, e, depth int) {
+	d := 0
+	for i := s; i < e; i++ {
+		tok := l.toks[i]
+		switch {
+		case isOpenBracket(tok):
+			d++
+		case isCloseBracket(tok):
+			d--
+		case d == depth && l.isName(i):
+			prev := l.toks[i-1]
+			if prev.is(pyOp, "(") || prev.is(pyOp, ",") || prev.is(pyOp, "*") || prev.is(pyOp, "**") ||
+				prev.is(pyName, "lambda") {
+				l.binds[i] = true
+			}
+		}
+	}
+}
+
+// simple checks the simple statement toks[s:e]
+func (l *pyLinter) simple(s, e int) error {
+	toks := l.toks
+	lambda := false
+	for i := s; i < e; i++ {
+		// yield in a lambda body makes the lambda a generator
+		lambda = lambda || toks[i].is(pyName, "lambda")
+		if toks[i].is(pyName, "yield") && !lambda && !l.inFunction() {
+			return toks[i].errorf("'yield' outside function")
+		}
+	}
+	tok := toks[s]
+	switch {
+	case tok.is(pyName, "import"):
+		l.importNames(s+1, e)
+	case tok.is(pyName, "from"):
+		l.fromImportNames(s+1, e)
+	case tok.is(pyName, "global") || tok.is(pyName, "nonlocal"):
+		for i := s + 1; i < e; i++ {
+			if l.isName(i) {
+				l.binds[i] = true
+			}
+		}
+	case tok.is(pyName, "return"):
+		if !l.inFunction() {
+			return tok.errorf("'return' outside function")
+		}
+		l.terminate(s)
+	case tok.is(pyName, "raise"):
+		l.terminate(s)
+	case tok.is(pyName, "break"):
+		if !l.inLoop() {
+			return tok.errorf("'break' outside loop")
+		}
+		l.terminate(s)
+	case tok.is(pyName, "continue"):
+		if !l.inLoop() {
+			return tok.errorf("'continue' not properly in loop")
+		}
+		l.terminate(s)
+	default:
+		l.assignment(s, e)
+	}
+	return nil
+}
+
+// terminate records that statements following toks[s] in its block do not run.
+// Statements after `if x: return` or `return; x` are not reported.
+func (l *pyLinter) terminate(s int) {
+	if l.inline == "" && (s == 0 || l.toks[s-1].Kind != pyOp) {
+		l.terminated = len(l.blocks)
+	}
+}
+
+// enclosing returns keywords of compound statements enclosing the current statement, innermost last
+func (l *pyLinter) enclosing() []string {
+	if l.inline == "" {
+		return l.blocks
+	}
+	return append(l.blocks[:len(l.blocks):len(l.blocks)], l.inline)
+}
+
+// inFunction reports whether the current statement is in a function body
+func (l *pyLinter) inFunction() bool {
+	blocks := l.enclosing()
+	for i := len(blocks) - 1; i >= 0; i-- {
+		switch blocks[i] {
+		case "def":
+			return true
+		case "class":
+			return false
+		}
+	}
+	return false
+}
+
+// inLoop reports whether the current statement is in a loop body of the same function
+func (l *pyLinter) inLoop() bool {
+	blocks := l.enclosing()
+	for i := len(blocks) - 1; i >= 0; i-- {
+		switch blocks[i] {
+		case "for", "while":
+			return true
+		case "def", "class":
+			return false
+		}
+	}
+	return false
+}
+
+// assignment marks targets of the assignment statement toks[s:e], if it is one
+func (l *pyLinter) assignment(s, e int) {
+	toks := l.toks
+	end, depth, lambdas := -1, 0, 0
+loop:
+	for i := s; i < e; i++ {
+		tok := toks[i]
+		switch {
+		case tok.is(pyName, "lambda") && depth == 0:
+			lambdas++
+		case isOpenBracket(tok):
+			depth++
+		case isCloseBracket(tok):
+			depth--
+		case depth > 0 || tok.Kind != pyOp:
+		case tok.Value == ":" && lambdas > 0:
+			lambdas--
+		case tok.Value == ":": // annotated assignment, target is before annotation
+			end = i
+			break loop
+		case tok.Value == "=" || pyAugmentedAssign[tok.Value]:
+			end = i
+		}
+	}
+	for i := s; i < end; i++ {
+		if !l.isName(i) {
+			continue
+		}
+		next := toks[i+1]
+		if next.is(pyOp, ",") || next.is(pyOp, "=") || next.is(pyOp, ")") || next.is(pyOp, "]") ||
+			next.is(pyOp, ":") || pyAugmentedAssign[next.Value] {
+			l.binds[i] = true
+		}
+	}
+}
+
+// importNames marks names bound by `import a.b as c, d` where toks[s:e] follow import
+func (l *pyLinter) importNames(s, e int) {
+	toks := l.toks
+	for i := s; i < e; i++ {
+		if !l.isName(i) {
+			continue
+		}
+		if toks[i-1].is(pyName, "as") {
+			l.importBind(i)
+			continue
+		}
+		// module root is bound unless the module is aliased
+		j := i
+		for j+2 < e && toks[j+1].is(pyOp, ".") {
+			j += 2
+		}
+		if j+1 < e && toks[j+1].is(pyName, "as") {
+			l.skips[i] = true
+		} else {
+			l.importBind(i)
+		}
+		i = j
+	}
+}
+
+// fromImportNames marks names bound by `from a.b import c as d, e` where toks[s:e] follow from
+func (l *pyLinter) fromImportNames(s, e int) {
+	toks := l.toks
+	imported := false
+	for i := s; i < e; i++ {
+		switch {
+		case toks[i].is(pyName, "import"):
+			imported = true
+		case !l.isName(i):
+		case !imported || i+1 < e && toks[i+1].is(pyName, "as"):
+			l.skips[i] = true
+		default:
+			l.importBind(i)
+		}
+	}
+}
+
+func (l *pyLinter) importBind(i int) {
+	l.binds[i] = true
+	l.imports = append(l.imports, i)
+}
+
+// expressions marks names bound or skipped inside expressions: for targets,
+// lambda parameters, assignment expressions, as aliases and keyword arguments
+func (l *pyLinter) expressions() {
+	toks := l.toks
+	var brackets []string
+	for i, tok := range toks {
+		switch {
+		case isOpenBracket(tok):
+			brackets = append(brackets, tok.Value)
+		case isCloseBracket(tok):
+			if len(brackets) > 0 {
+				brackets = brackets[:len(brackets)-1]
+			}
+		case tok.is(pyName, "for"):
+			l.targets(i+1, "in")
+		case tok.is(pyName, "as"):
+			l.targets(i+1, ",")
+		case tok.is(pyName, "lambda"):
+			l.params(i+1, l.lambdaEnd(i+1), 0)
+		case !l.isName(i) || i+1 >= len(toks):
+		case toks[i+1].is(pyOp, ":="):
+			l.binds[i] = true
+		case toks[i+1].is(pyOp, "=") && len(brackets) > 0 && brackets[len(brackets)-1] == "(":
+			l.skips[i] = true
+		}
+	}
+}
+
+// targets marks names of for targets or with/except aliases starting
+// at toks[s] up to the stop keyword or operator outside brackets
+func (l *pyLinter) targets(s int, stop string) {
+	depth := 0
+	for i := s; i < len(l.toks); i++ {
+		tok := l.toks[i]
+		switch {
+		case tok.Kind == pyNewline || tok.is(pyOp, ";"):
+			return
+		case isOpenBracket(tok):
+			depth++
+		case isCloseBracket(tok):
+			depth--
+			if depth < 0 {
+				return
+			}
+		case depth == 0 && (tok.Value == stop || tok.is(pyOp, ":") || tok.is(pyOp, "=")):
+			return
+		case l.isName(i) && i+1 < len(l.toks) && !l.toks[i+1].is(pyOp, ".") && !isOpenBracket(l.toks[i+1]):
+			l.binds[i] = true
+		}
+	}
+}
+
+// names reports undefined names and unused imports
+func (l *pyLinter) names() {
+	bound := make(map[string]bool, len(l.binds))
+	for i := range l.binds {
+		bound[l.toks[i].Value] = true
+	}
+	used := make(map[string]bool)
+	reported := make(map[string]bool)
+	for i, tok := range l.toks {
+		if !l.isName(i) || l.binds[i] || l.skips[i] || tok.Value == "_" {
+			continue
+		}
+		used[tok.Value] = true
+		if !bound[tok.Value] && !pyBuiltins[tok.Value] && !reported[tok.Value] {
+			reported[tok.Value] = true
+			l.warn(tok, "undefined name '%s'", tok.Value)
+		}
+	}
+	for _, i := range l.imports {
+		if tok := l.toks[i]; !used[tok.Value] {
+			l.warn(tok, "'%s' imported but unused", tok.Value)
+		}
+	}
+}
+
+func isOpenBracket(tok pyToken) bool {
+	return tok.is(pyOp, "(") || tok.is(pyOp, "[") || tok.is(pyOp, "{")
+}
+
+func isCloseBracket(tok pyToken) bool {
+	return tok.is(pyOp, ")") || tok.is(pyOp, "]") || tok.is(pyOp, "}")
+}
@@ -0,0 +1,69 @@
+package actions
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLintPy(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  string
+		// err is a substring of the blocking error, empty if the code compiles
+		err      string
+		warnings []string
+	}{
+		{name: "valid", src: "def f(n):\n    return n * 2\n\nprint(f(int(input())))\n"},
+		{name: "loop", src: "for i in range(3):\n    if i == 1:\n        break\n    continue\n"},
+		{name: "return outside function", src: "x = 1\nreturn x\n", err: "'return' outside function"},
+		{name: "return in class", src: "def f():\n    class A:\n        return 1\n", err: "'return' outside function"},
+		{name: "break outside loop", src: "if True:\n    break\n", err: "'break' outside loop"},
+		{name: "break in function in loop", src: "for i in range(3):\n    def g():\n        break\n", err: "'break' outside loop"},
+		{name: "continue outside loop", src: "continue\n", err: "'continue' not properly in loop"},
+		{name: "yield outside function", src: "yield 1\n", err: "'yield' outside function"},
+		{name: "yield in lambda", src: "x = lambda: (yield)\nprint(x)\n"},
+		{name: "missing colon", src: "def f(n)\n    return n\n", err: "expected ':'"},
+		{name: "inline body", src: "for i in range(3): break\nwhile True: break\n"},
+		{name: "f-string format spec in header", src: "for i in range(3):\n    def g():\n        pass\n    if f\"{i:>2}\" == ' 1':\n        break\n"},
+		{name: "f-string format spec after class", src: "def f():\n    class A:\n        pass\n    if f\"{1:>2}\" == ' 1':\n        return 1\n"},
+		{name: "f-string format spec is not annotation", src: "s = f\"{x:.2f}\"\nprint(s)\n", warnings: []string{"undefined name 'x'"}},
+		{name: "f-string nested field", src: "w = 4\nprint(f\"{3.14159:{w}.2f}\")\n"},
+		{name: "lambda in header", src: "if (lambda: 1)():\n    pass\nif sorted([2, 1], key=lambda v: -v):\n    pass\n"},
+		{name: "dict in header", src: "for k in {1: 2}:\n    print(k)\n"},
+		{name: "undefined name", src: "print(y)\nprint(y)\n", warnings: []string{"undefined name 'y'"}},
+		{name: "keyword argument", src: "print(1, end='')\n"},
+		{name: "walrus", src: "if (n := 3) > 2:\n    print(n)\n"},
+		{name: "unused import", src: "import math\nimport numpy as np\nfrom math import pi\n",
+			warnings: []string{"'math' imported but unused", "'np' imported but unused", "'pi' imported but unused"}},
+		{name: "used import", src: "import math\nprint(math.pi)\n"},
+		{name: "unreachable", src: "def f():\n    return 1\n    print(2)\n", warnings: []string{"unreachable code"}},
+		{name: "reachable after inline return", src: "def f(x):\n    if x: return 1\n    return 2\n"},
+		{name: "for and with targets", src: "for a, (b, c) in []:\n    print(a, b, c)\nwith open('x') as fh:\n    print(fh)\n"},
+		{name: "except alias", src: "try:\n    pass\nexcept ValueError as e:\n    print(e)\n"},
+		{name: "comprehension", src: "print([v * 2 for v in range(3)])\n"},
+		{name: "global", src: "def f():\n    global g\n    g = 1\nf()\nprint(g)\n"},
+		{name: "match", src: "match 3:\n    case 1 | 2:\n        pass\n    case n:\n        print(n)\n"},
+	} {
+		warnings, err := lintPy(test.src)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		var msgs []string
+		for _, w := range warnings {
+			msgs = append(msgs, w.Msg)
+		}
+		if len(msgs) != 0 || len(test.warnings) != 0 {
+			if !reflect.DeepEqual(msgs, test.warnings) {
+				t.Errorf("%s: got warnings %q, want %q", test.name, msgs, test.warnings)
+			}
+		}
+	}
+}
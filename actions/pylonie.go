@@ -4,14 +4,13 @@ import (
 	"archive/zip"
 	"crypto"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/big"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +20,7 @@ import (
 
 	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
 	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/buffalo/render"
 	"github.com/gobuffalo/pop/v5"
 	"github.com/gofrs/uuid"
 	"go.etcd.io/bbolt"
@@ -45,16 +45,18 @@ func InterpretPost(c buffalo.Context) error {
 	if p.code.Evaluation.String() != nullUUID {
 		return p.interpretEvaluation(c)
 	}
-	btx := c.Value("btx").(*bbolt.Tx)
+	kv := c.Value("kv").(models.KV)
+	datasets, err := runDatasets(c.Value("tx").(*pop.Connection), uuid.Nil)
+	if err != nil {
+		return p.codeResult(c, "", T.Translate(c, "app-status-internal-error"))
+	}
+	p.datasets = datasets
 
-	defer p.PutTx(btx, c)
-	chrootPath := envy.Get("GONTAINER_FS", "")
-	var err error
-	if chrootPath == "" {
-		err = p.runPy()
-	} else {
-		err = p.containerPy()
+	err = p.run(pyRunner)
+	if busy, ok := err.(*pyBusyError); ok {
+		return p.busyResult(c, busy)
 	}
+	defer p.PutTx(kv, c)
 	if err != nil {
 		return p.codeResult(c, p.result.Output, err.Error())
 	}
@@ -70,8 +72,8 @@ func (p pythonHandler) interpretEvaluation(c buffalo.Context) error {
 	// The value obtained from code submission as `input` is the team ID in the context of an
 	// evaluation. Reason being that there is no other input a user can have for the time being.
 	user := c.Value("current_user").(*models.User)
-	btx := c.Value("btx").(*bbolt.Tx)
-	if p.Exists(btx, c) && user.Subscribed(p.code.Evaluation) { // if code is duplicate and user already passed error out
+	kv := c.Value("kv").(models.KV)
+	if p.Exists(kv, c) && user.Subscribed(p.code.Evaluation) { // if code is duplicate and user already passed error out
 		return p.codeResult(c, "", T.Translate(c, "curso-python-evaluation-duplicate"))
 	}
 
@@ -97,57 +99,201 @@ func (p pythonHandler) interpretEvaluation(c buffalo.Context) error {
 	if err = q.First(eval); err != nil {
 		return p.codeResult(c, "", T.Translate(c, "curso-python-evaluation-not-found"))
 	}
-	peval := pythonHandler{}
-	peval.userID = p.userID
-	peval.Source = eval.Solution
-	chrootPath := envy.Get("GONTAINER_FS", "")
-	tests := strings.Split(strings.ReplaceAll(eval.Inputs.String, "\r", ""), "---\n")
-	passed := 0
-
-	for _, test := range tests {
-		peval.Input = teamID + "\n" + test
-		p.Input = test
-
-		if err = peval.runPy(); err != nil {
+	// admins may submit outside the availability window and without prerequisites to test evaluations
+	window := eval.Status()
+	if c.Value("role").(string) != "admin" {
+		switch window {
+		case models.EvaluationNotOpen:
+			return p.codeResult(c, "", T.Translate(c, "curso-python-evaluation-not-open",
+				render.Data{"OpensAt": eval.OpensAt.Time.Local().Format(evaluationTimeLayout)}))
+		case models.EvaluationClosed:
+			return p.codeResult(c, "", T.Translate(c, "curso-python-evaluation-closed"))
+		}
+		evals := models.Evaluations{}
+		if err = tx.Where("deleted = ?", false).All(&evals); err != nil {
+			return p.codeResult(c, "", T.Translate(c, "app-status-internal-error"))
+		}
+		if missing := evals.MissingPrerequisites(*eval, user); len(missing) > 0 {
+			return p.codeResult(c, "", T.Translate(c, "curso-python-evaluation-locked",
+				render.Data{"Prerequisites": evaluationTitles(missing)}))
+		}
+	}
+	p.policy, p.limits = evaluationPolicy(eval)
+	if p.datasets, err = runDatasets(tx, eval.ID); err != nil {
+		return p.codeResult(c, "", T.Translate(c, "app-status-internal-error"))
+	}
+	attempt := &models.Attempt{UserID: user.ID, EvaluationID: eval.ID, TeamID: teamID, Source: p.Source,
+		Late: window == models.EvaluationLate}
+	passed, ncases := 0, 0
+	var score, total float64
+	// record adds the result of a test case to the response and the attempt
+	record := func(name string, ok, hidden bool, weight float64, elapsed time.Duration, feedback string) {
+		ncases++
+		total += weight
+		if ok {
+			passed++
+			score += weight
+		}
+		if !hidden {
+			p.Cases = append(p.Cases, caseResult{Name: name, Passed: ok, Feedback: feedback})
+		}
+		attempt.Cases = append(attempt.Cases, models.AttemptCase{Name: name, Passed: ok, Hidden: hidden,
+			Weight: weight, Elapsed: elapsed, Feedback: feedback})
+	}
+	if eval.UnitTest() {
+		// sanitizer and lint errors are shown, errors while running are not. See below.
+		// runUnitTests does not check code since solutions are trusted
+		if err := p.check(); err != nil {
+			attempt.Error = err.Error()
+			saveAttempt(c, attempt)
+			return p.codeResult(c, "", err.Error())
+		}
+		tests, err := p.runUnitTests(pyRunner, eval)
+		if busy, ok := err.(*pyBusyError); ok {
+			return p.busyResult(c, busy)
+		}
+		if _, ok := err.(*pyHarnessError); ok {
 			if c.Value("role").(string) == "admin" {
-				return p.codeResult(c, peval.Output, "Evaluation errored! "+err.Error())
+				return p.codeResult(c, p.Output, "Evaluation errored! "+err.Error())
 			}
 			return p.codeResult(c, "", "Evaluation errored! "+err.Error())
 		}
-		if chrootPath == "" {
-			err = p.runPy()
+		if err != nil {
+			// which tests are hidden is unknown until the harness reports them so output
+			// and traceback, which may reveal hidden arguments, are never shown. Admins see the error in attempts
+			attempt.Error = err.Error()
+			saveAttempt(c, attempt)
+			p.Figures, p.Exception = nil, nil
+			return p.codeResult(c, "", T.Translate(c, "curso-python-evaluation-unit-test-error"))
+		}
+		elapsed := p.Elapsed[len(p.Elapsed)-1]
+		for _, t := range tests {
+			feedback := t.Message
+			if t.Passed {
+				feedback = ""
+			}
+			record(t.Name, t.Passed, t.Hidden, *t.Weight, elapsed, feedback)
+		}
+		return p.evaluationResult(c, eval, attempt, teamID, passed, ncases, score/total)
+	}
+	peval := pythonHandler{policy: p.policy, limits: p.limits, datasets: p.datasets}
+	peval.userID = p.userID
+	cases, err := eval.TestCases()
+	if err != nil {
+		return p.codeResult(c, "", "Evaluation errored! "+err.Error())
+	}
+	for k, tc := range cases {
+		p.Input = tc.Stdin
+		var expected string
+		fromSolution := tc.Expected == nil
+		if !fromSolution {
+			expected = *tc.Expected
 		} else {
-			err = p.containerPy()
+			if err = peval.runSolution(kv, eval, teamID, tc.Stdin); err != nil {
+				if busy, ok := err.(*pyBusyError); ok {
+					return p.busyResult(c, busy)
+				}
+				if c.Value("role").(string) == "admin" {
+					return p.codeResult(c, peval.Output, "Evaluation errored! "+err.Error())
+				}
+				return p.codeResult(c, "", "Evaluation errored! "+err.Error())
+			}
+			expected = peval.Output
 		}
-
-		if err != nil {
+		if err = p.run(pyRunner); err != nil {
+			if busy, ok := err.(*pyBusyError); ok {
+				return p.busyResult(c, busy)
+			}
+			attempt.Error = err.Error()
+			saveAttempt(c, attempt)
+			if tc.Hidden {
+				// output and traceback may reveal the hidden input. Admins see the error in attempts
+				p.Figures, p.Exception = nil, nil
+				return p.codeResult(c, "", T.Translate(c, "curso-python-evaluation-hidden-case-error", render.Data{"Case": k + 1}))
+			}
 			return p.codeResult(c, p.Output, err.Error())
 		}
-		if p.Output == peval.Output {
-			passed++
-		} else {
+		elapsed := p.Elapsed[len(p.Elapsed)-1]
+		ok, feedback, err := p.compareOutput(eval, tc, expected, fromSolution)
+		if busy, isBusy := err.(*pyBusyError); isBusy {
+			return p.busyResult(c, busy)
+		}
+		if err != nil {
+			return p.codeResult(c, "", "Evaluation errored! "+err.Error())
+		}
+		if !ok {
 			p.Elapsed[len(p.Elapsed)-1] = 0
 		}
+		record(tc.Name, ok, tc.Hidden, tc.Weight, elapsed, feedback)
 	}
-	defer p.PutTx(btx, c)
-	if float64(passed)/float64(len(tests)) < 0.4 {
-		msg := fmt.Sprintf("%s ID:%s\n(%d/%d) casos bien", T.Translate(c, "curso-python-evaluation-fail"), teamID, passed, len(tests))
-		return p.codeResult(c, "", msg)
+	return p.evaluationResult(c, eval, attempt, teamID, passed, ncases, score/total)
+}
+
+// evaluationResult saves the graded attempt, subscribes the user to eval
+// if it passed and responds with the score and test case results.
+// Late attempts pass by their score but it is recorded multiplied by
+// the evaluation's late multiplier.
+func (p *pythonHandler) evaluationResult(c buffalo.Context, eval *models.Evaluation, attempt *models.Attempt, teamID string, passed, ncases int, score float64) error {
+	user := c.Value("current_user").(*models.User)
+	tx := c.Value("tx").(*pop.Connection)
+	p.Score = score
+	attempt.Passed = score >= eval.PassThreshold
+	var late string
+	if attempt.Late {
+		p.Score *= eval.LateMultiplier
+		late = "\n" + T.Translate(c, "curso-python-evaluation-late", render.Data{"Multiplier": fmt.Sprintf("%.0f%%", 100*eval.LateMultiplier)})
+	}
+	attempt.Score = p.Score
+	summary := T.Translate(c, "curso-python-evaluation-score", render.Data{"TeamID": teamID, "Passed": passed,
+		"Cases": ncases, "Score": fmt.Sprintf("%.0f%%", 100*p.Score)}) + late + p.casesSummary()
+	defer p.PutTx(c.Value("kv").(models.KV), c)
+	if !attempt.Passed {
+		saveAttempt(c, attempt)
+		return p.codeResult(c, "", T.Translate(c, "curso-python-evaluation-fail")+" "+summary)
 	}
 	user.AddSubscription(eval.ID)
 	_ = tx.UpdateColumns(user, "subscriptions")
-	msg := fmt.Sprintf("%s ID:%s\n(%d/%d) casos bien", T.Translate(c, "curso-python-evaluation-success"), teamID, passed, len(tests))
-	err = newEvaluationSuccessNotify(c, eval) // this is the same as go newEvaluationSuccessNotify(c,eval). The closure is to avoid golint from picking up errors
+	saveAttempt(c, attempt)
+	msg := T.Translate(c, "curso-python-evaluation-success") + " " + summary
+	err := newEvaluationSuccessNotify(c, eval) // this is the same as go newEvaluationSuccessNotify(c,eval). The closure is to avoid golint from picking up errors
 	if err != nil {
 		c.Logger().Errorf("sending evaluation success mail to %s", user.Email)
 	}
 	return p.codeResult(c, msg)
 }
 
-// DeletePythonUploads delete all python uploads in bbolt DB
+// saveAttempt stores an evaluation attempt. Errors are logged
+// since failing to store an attempt should not fail the submission.
+func saveAttempt(c buffalo.Context, attempt *models.Attempt) {
+	tx := c.Value("tx").(*pop.Connection)
+	if verrs, err := tx.ValidateAndCreate(attempt); err != nil || verrs.HasAny() {
+		c.Logger().Errorf("saving attempt of user %s at evaluation %s: %v %v", attempt.UserID, attempt.EvaluationID, err, verrs)
+	}
+}
+
+// casesSummary lists visible test cases and whether they passed
+func (p *pythonHandler) casesSummary() string {
+	var b strings.Builder
+	for _, cr := range p.Cases {
+		mark := "✗"
+		if cr.Passed {
+			mark = "✓"
+		}
+		b.WriteString("\n" + mark + " " + cr.Name)
+		if cr.Feedback != "" {
+			b.WriteString("\n    " + strings.ReplaceAll(cr.Feedback, "\n", "\n    "))
+		}
+	}
+	return b.String()
+}
+
+// DeletePythonUploads delete all python uploads in key/value storage
 func DeletePythonUploads(c buffalo.Context) error {
-	btx := c.Value("btx").(*bbolt.Tx)
-	if err := btx.DeleteBucket([]byte(pyDBUploadBucketName)); err != nil {
+	kv := c.Value("kv").(models.KV)
+	if err := kv.Clear(pyDBUploadBucketName); err != nil {
+		return c.Error(500, err)
+	}
+	if err := kv.Clear(pyDBUploadTimeBucketName); err != nil {
 		return c.Error(500, err)
 	}
 	c.Flash().Add("success", "Uploads deleted. Hope you know what you are doing")
@@ -170,15 +316,29 @@ func (p *pythonHandler) codeResult(c buffalo.Context, output ...string) error {
 	if len(p.Output) > pyMaxOutputLength {
 		p.Output = p.Output[:pyMaxOutputLength] + " \n" + T.Translate(c, "curso-python-interpreter-output-too-long")
 	}
+	p.Exception.explain(c)
 	jsonResponse, _ := json.Marshal(p.result)
 	c.Response().WriteHeader(200) // all good status so tx is committed
 	_, _ = c.Response().Write(jsonResponse)
 	return nil
 }
 
+// busyResult responds with 503 when there are no free workers to
+// run code. Nothing is stored since the code was never run.
+func (p *pythonHandler) busyResult(c buffalo.Context, busy *pyBusyError) error {
+	p.result.Output = ""
+	p.result.Error = T.Translate(c, "curso-python-interpreter-busy", render.Data{"seconds": busy.seconds()})
+	jsonResponse, _ := json.Marshal(p.result)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(busy.seconds()))
+	c.Response().WriteHeader(503)
+	_, _ = c.Response().Write(jsonResponse)
+	return nil
+}
+
 var (
 	// Set in init()
 	pyTimeoutDuration time.Duration
+	pyLimits          RunLimits
 )
 
 // configuration values
@@ -187,7 +347,7 @@ const (
 	// [Milliseconds] after running python code for this time the process is killed
 
 	// DB:
-	// this Bucket name must coincide with one defined in init() in models/bbolt.go
+	// this bucket name must be in models.KVBuckets
 	pyDBUploadBucketName = "pyUploads"
 	pyMaxSourceLength    = 1200 // DB storage trim length
 	pyMaxOutputLength    = 2000 // in characters
@@ -197,6 +357,21 @@ func init() {
 	var err error
 	pyTimeoutDuration, err = time.ParseDuration(envy.Get("PY_TIMEOUT", "500ms"))
 	must(err)
+	pyLimits.Timeout = pyTimeoutDuration
+	pyLimits.CPUTime, err = time.ParseDuration(envy.Get("PY_MAX_CPU", "1s"))
+	must(err)
+	memMB, err := strconv.Atoi(envy.Get("PY_MAX_MEMORY", "512"))
+	must(err)
+	pyLimits.Memory = int64(memMB) * 1e6
+	// RLIMIT_NPROC counts all processes of the user running the server so it is disabled by default
+	pyLimits.Processes, err = strconv.Atoi(envy.Get("PY_MAX_PROCS", "0"))
+	must(err)
+	pyLimits.MaxOutput, err = strconv.Atoi(envy.Get("PY_MAX_OUTPUT", "65536"))
+	must(err)
+	pyLimits.MaxFigures, err = strconv.Atoi(envy.Get("PY_MAX_FIGURES", "4"))
+	must(err)
+	pyLimits.MaxFigureSize, err = strconv.Atoi(envy.Get("PY_MAX_FIGURE_SIZE", "1000000"))
+	must(err)
 }
 
 type pyExitStatus int
@@ -217,6 +392,25 @@ type result struct {
 	Output  string          `json:"output"`
 	Error   string          `json:"error"`
 	Elapsed []time.Duration `json:"elapsed"`
+	// Limit is the resource limit that killed the process, if any
+	Limit string `json:"limit,omitempty"`
+	// Cases are the results of visible evaluation test cases
+	Cases []caseResult `json:"cases,omitempty"`
+	// Score is the weighted fraction of evaluation test cases passed
+	Score float64 `json:"score,omitempty"`
+	// Figures are matplotlib figures created by the run
+	Figures []pyFigure `json:"figures,omitempty"`
+	// Warnings are findings of the static checks run before the code, see pylint.go
+	Warnings []pyWarning `json:"warnings,omitempty"`
+	// Exception is the parsed traceback of a failed run
+	Exception *pyException `json:"exception,omitempty"`
+}
+
+type caseResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Feedback is a diff between expected and actual output or the checker's message
+	Feedback string `json:"feedback,omitempty"`
 }
 
 type pythonHandler struct {
@@ -227,231 +421,180 @@ type pythonHandler struct {
 	UserName string `json:"user"`
 	userID   string
 	Filename string `json:"-" form:"-"`
+	// policy and limits default to defaultPyPolicy and pyLimits if not set
+	policy *pyPolicy
+	limits *RunLimits
+	// stdin and stream are set for interactive runs. See RunJob
+	stdin  io.Reader
+	stream func(stream string, chunk []byte)
+	// datasets are placed in the working directory. See RunJob
+	datasets map[string]string
 }
 
-// reForbid sanitization structures
-var reForbid = map[*regexp.Regexp]string{
-	regexp.MustCompile(`exec|eval|globals|locals|write|breakpoint|getattr|memoryview|vars|super`): "forbidden function key '%s'",
-	//regexp.MustCompile(`input\s*\(`):                           "no %s) to parse!",
-	regexp.MustCompile(`tofile|savetxt|fromfile|fromtxt|load\s*\(`): "forbidden numpy function key '%s'",
-	regexp.MustCompile("dump"):                                      "forbidden json function key '%s'",
-	regexp.MustCompile("to_csv|to_json|to_html|to_clipboard|to_excel|to_hdf|to_feather|to_parquet|to_msgpack|to_stata|to_pickle|to_sql|to_gbq"): "forbidden pandas function key '%s'",
-	regexp.MustCompile(`__\w+__`): "forbidden dunder function key '%s'",
+// run sanitizes, lints and runs python code with runner. The combined
+// output (stderr+stdout) is saved to the pythonHandler Output field
+// if code ran successfully, else it is returned as the error.
+// Static check warnings are saved to Warnings and do not stop the run.
+func (p *pythonHandler) run(runner Runner) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	return p.runSource(runner, p.Source, nil, "")
 }
 
-// special treatment for imports since we may allow special imports such as math, numpy, pandas
-var reImport = regexp.MustCompile(`^from[\s]+[\w]+|import[\s]+[\w]+`)
-
-var allowedImports = map[string]bool{
-	"math":       true,
-	"numpy":      true,
-	"pandas":     true,
-	"json":       true,
-	"itertools":  false,
-	"processing": false,
-	"os":         false,
+// sandbox returns the policy and limits of runs
+func (p *pythonHandler) sandbox() (*pyPolicy, *RunLimits) {
+	policy, limits := &defaultPyPolicy, &pyLimits
+	if p.policy != nil {
+		policy = p.policy
+	}
+	if p.limits != nil {
+		limits = p.limits
+	}
+	return policy, limits
 }
 
-// containerPy This function runs python in a container (only works on linux)
-// thus it is safe from hackers. Can't touch this requires installing
-// github.com/soypat/gontainer in PATH. Also requires setting GONTAINER_FS
-// to the path of the filesystem that will be containerized.
-func (p *pythonHandler) containerPy() (err error) {
-	chrootPath := envy.Get("GONTAINER_FS", "")
-	if chrootPath == "" {
-		return fmt.Errorf("GONTAINER_FS environment variable not set. see https://alpinelinux.org/ for a minimal filesystem")
-	}
-	err = p.code.sanitizePy()
-	output := make([]byte, 0)
+// check sanitizes and lints the user's code
+func (p *pythonHandler) check() error {
+	policy, _ := p.sandbox()
+	if err := p.code.sanitizePy(policy); err != nil {
+		return err
+	}
+	warnings, err := lintPy(p.Source)
 	if err != nil {
-		return
+		return err
 	}
-	userDir := fmt.Sprintf("/home/%s-%s", p.UserName, p.userID[0:5])
-	if _, err := os.Stat(filepath.Join(chrootPath, userDir)); os.IsNotExist(err) {
-		_ = os.Mkdir(filepath.Join(chrootPath, userDir), os.ModeDir)
+	p.Warnings, p.Exception = warnings, nil
+	return nil
+}
+
+// runSource runs source with the user's input and datasets as run does.
+// files are placed in the working directory with the datasets.
+// userFile is the name of the file with the user's code in tracebacks,
+// see parseTraceback.
+func (p *pythonHandler) runSource(runner Runner, source string, files map[string][]byte, userFile string) error {
+	_, limits := p.sandbox()
+	// evaluation limits are configured by admins and never raised
+	if p.limits == nil {
+		limits = figureLimits(p.Source, limits)
+	}
+	res, err := pyWorkers.Run(runner, &RunJob{
+		Source:   source,
+		Input:    p.Input,
+		UserName: p.UserName,
+		UserID:   p.userID,
+		Limits:   *limits,
+		Stdin:    p.stdin,
+		Stream:   p.stream,
+		Files:    files,
+		Datasets: p.datasets,
+	})
+	if busy, ok := err.(*pyBusyError); ok {
+		return busy
 	}
-	chrootFilename := filepath.Join(userDir, "f.py")
-	filename := filepath.Join(chrootPath, chrootFilename)
-	f, err := os.Create(filename)
 	if err != nil {
-		return
+		return fmt.Errorf("server error running python: %s", err)
 	}
-	defer func() {
-		f.Close()
-	}()
-	_, err = f.Write([]byte(p.code.Source))
-	if err != nil {
+	p.Elapsed = append(p.Elapsed, res.Elapsed)
+	p.Output, p.Limit, p.Figures = "", res.Limit, res.Figures
+	if res.Limit == limitOutput {
+		p.Output = res.Output
+	}
+	if err = limitError(res, limits); err != nil {
 		return err
 	}
-	gontainerArgs := []string{"run", "--chdr", userDir, "--chrt", chrootPath,
-		"--timeout", (pyTimeoutDuration + time.Second).String(), pyCommand, chrootFilename}
-	cmd := exec.Command("gontainer", gontainerArgs...)
-	defer func() {
-		_ = cmd.Process.Kill()
-	}()
-	stdin, _ := cmd.StdinPipe()
-	go func() {
-		_, _ = stdin.Write([]byte(p.Input + "\n"))
-	}()
-	status := make(chan pyExitStatus, 1)
-	go func() {
-		time.Sleep(pyTimeoutDuration)
-		status <- pyTimeout
-	}()
-	var tstart time.Time
-	go func() {
-		tstart = time.Now()
-		output, err = cmd.CombinedOutput()
-		if err != nil {
-			status <- pyError
-		} else {
-			status <- pyOK
-		}
-	}()
-
-	switch <-status {
-	case pyTimeout:
-		p.Elapsed = append(p.Elapsed, pyTimeoutDuration)
-		return fmt.Errorf("process timed out (%s)", pyTimeoutDuration)
-	case pyError, pyOK:
-		p.Elapsed = append(p.Elapsed, time.Since(tstart))
-		replaced := strings.ReplaceAll(string(output), "\""+chrootFilename+"\",", "")
-		if strings.Index(string(output), chrootFilename) > 0 {
-			return fmt.Errorf(replaced)
-		}
-		p.Output = replaced
-		return
+	if res.Status == pyError {
+		p.Exception = parseTraceback(res.Output, userFile, p.Source)
+		return errors.New(res.Output)
 	}
-	return fmt.Errorf("server error in container")
-
+	p.Output = res.Output
+	return nil
 }
 
-// runPy this function runs python on the machine python
-// installation. It creates a file in /tmp/{userID}
-// and runs it as stdin. The combined output (stderr+stdout)
-// is saved to the pythonHandler Output field.
-func (p *pythonHandler) runPy() (err error) {
-	err = p.code.sanitizePy()
-	output := make([]byte, 0)
-	if err != nil {
-		return
+// limitError describes the limit res exceeded or returns nil if no limit was exceeded
+func limitError(res RunResult, limits *RunLimits) error {
+	switch res.Limit {
+	case limitTimeout:
+		return fmt.Errorf("process timed out (%s)", limits.Timeout)
+	case limitCPU:
+		return fmt.Errorf("process exceeded CPU time limit (%s)", limits.CPUTime)
+	case limitMemory:
+		return fmt.Errorf("process exceeded memory limit (%dMB)\n%s", limits.Memory/1e6, res.Output)
+	case limitProcesses:
+		return fmt.Errorf("process exceeded process limit (%d)\n%s", limits.Processes, res.Output)
+	case limitOutput:
+		return fmt.Errorf("process output exceeded %d bytes and was killed", limits.MaxOutput)
 	}
-	err = os.Mkdir(fmt.Sprintf("tmp/%s", p.userID), os.ModeDir)
-	if err != nil && os.IsNotExist(err) {
-		return fmt.Errorf("in runPy() mkdir: %s", err)
-	}
-	filename := fmt.Sprintf("tmp/%s/f.py", p.userID)
-	f, err := os.Create(filename)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	_, _ = f.Write([]byte(p.code.Source))
-	cmd := exec.Command(pyCommand, filename)
-	stdin, _ := cmd.StdinPipe()
-	go func() {
-		_, _ = stdin.Write([]byte(p.Input + "\n"))
-	}()
-	status := make(chan pyExitStatus, 1)
-	go func() {
-		time.Sleep(pyTimeoutDuration)
-		status <- pyTimeout
-	}()
-	var tstart time.Time
-	go func() {
-		tstart = time.Now()
-		output, err = cmd.CombinedOutput()
-		if err != nil {
-			status <- pyError
-		} else {
-			status <- pyOK
-		}
-	}()
-
-	switch stat := <-status; stat {
-	case pyTimeout:
-		_ = cmd.Process.Kill()
-		p.Elapsed = append(p.Elapsed, pyTimeoutDuration)
-		return fmt.Errorf("process timed out (%s)", pyTimeoutDuration)
-	case pyError, pyOK:
-		p.Elapsed = append(p.Elapsed, time.Since(tstart))
-		p.Output = strings.ReplaceAll(string(output), "\""+filename+"\",", "")
-		return
-	}
-	_ = cmd.Process.Kill()
 	return nil
 }
 
-func (c *code) sanitizePy() error {
-	if len(c.Source) > pyMaxSourceLength {
-		return fmt.Errorf("code snippet too long (%d/%d)", len(c.Source), pyMaxSourceLength)
-	}
-	semicolonSplit := strings.Split(c.Source, ";")
-	newLineSplit := strings.Split(c.Source, "\n")
-	for _, v := range append(semicolonSplit, newLineSplit...) {
-		for re, errF := range reForbid {
-			str := re.FindString(strings.TrimSpace(v))
-			if str != "" {
-				return fmt.Errorf(errF, str)
-			}
+// sanitizePy checks code complies with policy
+func (c *code) sanitizePy(policy *pyPolicy) error {
+	return policy.check(c.Source)
+}
+
+// evaluationPolicy returns the sandbox policy and limits for
+// an evaluation. Settings not set in evaluation take default values.
+// If AllowedImports is set it replaces the default import safelist.
+// Forbidden names may be module names, in which case importing them is forbidden.
+func evaluationPolicy(eval *models.Evaluation) (*pyPolicy, *RunLimits) {
+	policy, limits := defaultPyPolicy, pyLimits
+	if imports := models.PolicyList(eval.AllowedImports); len(imports) > 0 {
+		policy.AllowedImports = setOf(imports...)
+	} else {
+		policy.AllowedImports = make(map[string]bool, len(defaultPyPolicy.AllowedImports))
+		for k, v := range defaultPyPolicy.AllowedImports {
+			policy.AllowedImports[k] = v
 		}
-		str := reImport.FindString(strings.TrimSpace(v))
-		if str != "" {
-			words := strings.Split(str, " ")
-			if len(words) < 2 {
-				return fmt.Errorf("unexpected import formatting: %s", str)
-			}
-			allowed, present := allowedImports[strings.TrimSpace(words[1])]
-			if !present {
-				return fmt.Errorf("import '%s' not in safelist:\n%s", strings.TrimSpace(words[1]), printSafeList())
-			}
-			if !allowed {
-				return fmt.Errorf("forbidden import '%s'", strings.TrimSpace(words[1]))
+	}
+	if forbidden := models.PolicyList(eval.ForbiddenNames); len(forbidden) > 0 {
+		policy.ForbiddenNames = setOf(forbidden...)
+		for k := range defaultPyPolicy.ForbiddenNames {
+			policy.ForbiddenNames[k] = true
+		}
+		for _, name := range forbidden {
+			if _, isModule := policy.AllowedImports[name]; isModule {
+				policy.AllowedImports[name] = false
 			}
 		}
 	}
-	return nil
-}
-
-// printSafeList shows user what imports can
-// be used in interpreter
-func printSafeList() (s string) {
-	counter := 0
-	for k, v := range allowedImports {
-		if v {
-			counter++
-			if counter > 1 {
-				s += ",  "
-			}
-			s += k
+	if eval.MaxSourceLength > 0 {
+		policy.MaxSourceLength = eval.MaxSourceLength
+	}
+	if timeout, err := time.ParseDuration(eval.Timeout); err == nil && timeout > 0 {
+		limits.Timeout = timeout
+		if limits.CPUTime < timeout {
+			limits.CPUTime = timeout
 		}
 	}
-	return
+	return &policy, &limits
 }
 
 // Exists check if code has already been submitted to database
 // Depends on pythonhandler having both Source and UserName fields
-func (p *pythonHandler) Exists(tx *bbolt.Tx, c buffalo.Context) bool {
+func (p *pythonHandler) Exists(kv models.KV, c buffalo.Context) bool {
 	src := p.Source
 	if len(src) > pyMaxSourceLength {
 		src = src[:pyMaxSourceLength]
 	}
-	b := tx.Bucket([]byte(pyDBUploadBucketName))
 	h := crypto.MD5.New()
 	_, _ = h.Write([]byte(p.UserName + src))
 	sum := h.Sum(nil)
-	return b.Get(sum) != nil
+	v, err := kv.Get(pyDBUploadBucketName, sum)
+	if err != nil {
+		c.Logger().Errorf("checking python code exists: %s", err)
+		return false
+	}
+	return v != nil
 }
 
-// Saves Python code and user to database
-func (p *pythonHandler) PutTx(tx *bbolt.Tx, c buffalo.Context) {
+// Saves Python code and user to database. May begin a writable transaction
+// so it should be called after running code.
+func (p *pythonHandler) PutTx(kv models.KV, c buffalo.Context) {
 	// closure eases error management
 	err := func() error {
-		b, err := tx.CreateBucketIfNotExists([]byte(pyDBUploadBucketName))
-		if err != nil {
-			return err
-		}
-		p.Time = time.Now().String()
+		p.Timecode = time.Now()
+		p.Time = p.Timecode.String()
 		// var pc pythonHandler
 		pc := *p // because we don't want to store 5000000 length outputs
 		if len(pc.Output) > pyMaxOutputLength {
@@ -460,6 +603,7 @@ func (p *pythonHandler) PutTx(tx *bbolt.Tx, c buffalo.Context) {
 		if len(pc.Source) > pyMaxSourceLength {
 			pc.Source = pc.Source[:pyMaxSourceLength]
 		}
+		pc.Figures = nil // figures are only sent back to the user
 		buff, err := json.Marshal(pc)
 		if err != nil {
 			return err
@@ -467,9 +611,13 @@ func (p *pythonHandler) PutTx(tx *bbolt.Tx, c buffalo.Context) {
 		h := crypto.MD5.New()
 		_, _ = h.Write([]byte(pc.UserName + pc.code.Source))
 		sum := h.Sum(nil)
-		if b.Get(sum) == nil {
+		stored, err := kv.PutIfAbsent(pyDBUploadBucketName, sum, buff)
+		if err != nil {
+			return err
+		}
+		if stored {
 			c.Logger().Infof("Code submitted user: %s", pc.UserName)
-			return b.Put(sum, buff)
+			return indexPyRun(kv, sum, &pc)
 		}
 		c.Logger().Infof("Repeated code submitted user: %s", pc.UserName)
 		return nil
@@ -0,0 +1,138 @@
+package actions
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+)
+
+// pyWorkers bounds python processes running at the same time
+// for the whole server. Set in init()
+var pyWorkers *pyPool
+
+func init() {
+	workers, err := strconv.Atoi(envy.Get("PY_WORKERS", strconv.Itoa(runtime.NumCPU())))
+	must(err)
+	queue, err := strconv.Atoi(envy.Get("PY_QUEUE", strconv.Itoa(4*workers)))
+	must(err)
+	pyWorkers = newPyPool(workers, queue)
+}
+
+// pyPool is a worker pool for python runs. Runs are executed
+// as soon as a worker is free. If all workers are busy runs wait in a
+// queue of bounded length. Once the queue is full runs are rejected
+// with a *pyBusyError.
+type pyPool struct {
+	workers  chan struct{}
+	maxQueue int
+
+	mu       sync.Mutex
+	queued   int
+	avgWait  time.Duration
+	avgRun   time.Duration
+	served   uint64
+	rejected uint64
+}
+
+// pyPoolStats is a snapshot of the pool's state shown to admins
+type pyPoolStats struct {
+	Workers  int           `json:"workers"`
+	Running  int           `json:"running"`
+	Queued   int           `json:"queued"`
+	MaxQueue int           `json:"max_queue"`
+	AvgWait  time.Duration `json:"avg_wait"`
+	AvgRun   time.Duration `json:"avg_run"`
+	Served   uint64        `json:"served"`
+	Rejected uint64        `json:"rejected"`
+}
+
+// pyBusyError is returned when the pool's queue is full
+type pyBusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *pyBusyError) Error() string {
+	return fmt.Sprintf("server busy, retry in %d seconds", e.seconds())
+}
+
+func (e *pyBusyError) seconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+func newPyPool(workers, maxQueue int) *pyPool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &pyPool{workers: make(chan struct{}, workers), maxQueue: maxQueue}
+}
+
+// Run runs job with runner once a worker is free
+func (pool *pyPool) Run(runner Runner, job *RunJob) (RunResult, error) {
+	pool.mu.Lock()
+	select {
+	case pool.workers <- struct{}{}:
+		pool.mu.Unlock()
+	default:
+		if pool.queued >= pool.maxQueue {
+			pool.rejected++
+			retry := pool.avgRun * time.Duration(pool.queued+1) / time.Duration(cap(pool.workers))
+			pool.mu.Unlock()
+			if retry < time.Second {
+				retry = time.Second
+			}
+			return RunResult{}, &pyBusyError{RetryAfter: retry}
+		}
+		pool.queued++
+		pool.mu.Unlock()
+		tstart := time.Now()
+		pool.workers <- struct{}{}
+		pool.mu.Lock()
+		pool.queued--
+		pool.avgWait = movingAverage(pool.avgWait, time.Since(tstart), pool.served)
+		pool.mu.Unlock()
+	}
+	defer func() { <-pool.workers }()
+	tstart := time.Now()
+	res, err := runner.Run(job)
+	pool.mu.Lock()
+	pool.avgRun = movingAverage(pool.avgRun, time.Since(tstart), pool.served)
+	pool.served++
+	pool.mu.Unlock()
+	return res, err
+}
+
+// movingAverage adds sample to an exponential moving average. The
+// first sample (n==0) is taken as the average.
+func movingAverage(avg, sample time.Duration, n uint64) time.Duration {
+	if n == 0 {
+		return sample
+	}
+	return avg + (sample-avg)/8
+}
+
+// Stats returns current state of pool. Averages are exponential moving averages
+func (pool *pyPool) Stats() pyPoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pyPoolStats{
+		Workers:  cap(pool.workers),
+		Running:  len(pool.workers),
+		Queued:   pool.queued,
+		MaxQueue: pool.maxQueue,
+		AvgWait:  pool.avgWait,
+		AvgRun:   pool.avgRun,
+		Served:   pool.served,
+		Rejected: pool.rejected,
+	}
+}
+
+// pyPoolStatsGet responds with python worker pool stats as JSON. For admins
+func pyPoolStatsGet(c buffalo.Context) error {
+	return c.Render(200, r.JSON(pyWorkers.Stats()))
+}
@@ -0,0 +1,251 @@
+package actions
+
+// Retention of python runs stored by PutTx. Runs are indexed by
+// time in a second bucket so old runs are found without decoding
+// the whole uploads bucket. Index keys are the big endian unix
+// nanosecond timestamp of the run followed by the run's key.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/buffalo/render"
+	"github.com/gobuffalo/envy"
+	"github.com/gofrs/uuid"
+)
+
+// this bucket name must be in models.KVBuckets
+const pyDBUploadTimeBucketName = "pyUploadsTime"
+
+// pyRetentionPolicy decides which stored runs are pruned. Zero values do not prune
+type pyRetentionPolicy struct {
+	// MaxAge runs older than this are pruned
+	MaxAge time.Duration
+	// MaxPerUser only the most recent runs of each user are kept
+	MaxPerUser int
+	// KeepEvaluations evaluation runs are never pruned
+	KeepEvaluations bool
+	// Interval between background prunes
+	Interval time.Duration
+}
+
+// Set in init()
+var pyRetention pyRetentionPolicy
+
+func init() {
+	var err error
+	pyRetention.MaxAge, err = time.ParseDuration(envy.Get("PY_RUNS_MAX_AGE", "0"))
+	must(err)
+	pyRetention.MaxPerUser, err = strconv.Atoi(envy.Get("PY_RUNS_MAX_PER_USER", "0"))
+	must(err)
+	pyRetention.KeepEvaluations, err = strconv.ParseBool(envy.Get("PY_RUNS_KEEP_EVALUATIONS", "true"))
+	must(err)
+	pyRetention.Interval, err = time.ParseDuration(envy.Get("PY_RUNS_PRUNE_INTERVAL", "1h"))
+	must(err)
+}
+
+// Enabled reports whether policy prunes any runs
+func (p pyRetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxPerUser > 0
+}
+
+// pyRunIndexEntry is the value of a time index entry. Holds what
+// is needed to apply retention policy without reading the run.
+type pyRunIndexEntry struct {
+	UserID string `json:"user_id,omitempty"`
+	// User is the user name of runs whose user ID is not known,
+	// i.e. indexed by reindexPyRuns or before IDs were stored
+	User       string `json:"user,omitempty"`
+	Evaluation bool   `json:"eval"`
+}
+
+// owner returns the key runs are grouped by in MaxPerUser. Users
+// may share a name so the name is only used without user ID.
+func (e pyRunIndexEntry) owner() string {
+	if e.UserID != "" {
+		return "id:" + e.UserID
+	}
+	return "name:" + e.User
+}
+
+func pyRunIndexKey(t time.Time, key []byte) []byte {
+	ikey := make([]byte, 8, 8+len(key))
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(ikey, uint64(t.UnixNano()))
+	}
+	return append(ikey, key...)
+}
+
+// indexPyRun adds run stored under key to time index
+func indexPyRun(kv models.KV, key []byte, p *pythonHandler) error {
+	entry := pyRunIndexEntry{UserID: p.userID, Evaluation: p.Evaluation != uuid.Nil}
+	if entry.UserID == "" {
+		// user ID is not stored with runs
+		entry.User = p.UserName
+	}
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return kv.Put(pyDBUploadTimeBucketName, pyRunIndexKey(runTime(p), key), v)
+}
+
+// deletePyRun deletes a stored run and its time index entry
+func deletePyRun(kv models.KV, key []byte) error {
+	v, err := kv.Get(pyDBUploadBucketName, key)
+	if err != nil || v == nil {
+		return err
+	}
+	var p pythonHandler
+	if err = json.Unmarshal(v, &p); err != nil {
+		return err
+	}
+	if err = kv.Delete(pyDBUploadTimeBucketName, pyRunIndexKey(runTime(&p), key)); err != nil {
+		return err
+	}
+	return kv.Delete(pyDBUploadBucketName, key)
+}
+
+// reindexPyRuns builds time index for runs stored before index existed
+func reindexPyRuns(kv models.KV) (n int, err error) {
+	type run struct {
+		key []byte
+		p   pythonHandler
+	}
+	var runs []run
+	err = kv.ForEach(pyDBUploadBucketName, nil, func(k, v []byte) error {
+		r := run{key: k}
+		if err := json.Unmarshal(v, &r.p); err != nil {
+			return nil // undecodable runs can't be pruned
+		}
+		runs = append(runs, r)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := range runs {
+		if err = indexPyRun(kv, runs[i].key, &runs[i].p); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+var errStopIteration = errors.New("stop iteration")
+
+// pyRunIndexedKey is present in time index once runs stored before
+// the index existed have been indexed. Shorter than index keys.
+var pyRunIndexedKey = []byte("indexed")
+
+// ensurePyRunIndex builds the time index if runs stored before it
+// existed were not indexed.
+func ensurePyRunIndex(kv models.KV) error {
+	indexed, err := kv.Get(pyDBUploadTimeBucketName, pyRunIndexedKey)
+	if err != nil || indexed != nil {
+		return err
+	}
+	if _, err = reindexPyRuns(kv); err != nil {
+		return err
+	}
+	return kv.Put(pyDBUploadTimeBucketName, pyRunIndexedKey, []byte{1})
+}
+
+// prunePyRuns deletes runs not kept by policy and returns amount deleted.
+// The time index is built first if runs stored before it existed were not indexed.
+func prunePyRuns(kv models.KV, policy pyRetentionPolicy, now time.Time) (n int, err error) {
+	if !policy.Enabled() {
+		return 0, nil
+	}
+	if err = ensurePyRunIndex(kv); err != nil {
+		return 0, err
+	}
+	var cutoff uint64
+	if policy.MaxAge > 0 {
+		cutoff = uint64(now.Add(-policy.MaxAge).UnixNano())
+	}
+	var prune [][]byte
+	// user's index keys oldest first
+	perUser := make(map[string][][]byte)
+	err = kv.ForEach(pyDBUploadTimeBucketName, nil, func(k, v []byte) error {
+		if len(k) < 8 {
+			return nil
+		}
+		old := binary.BigEndian.Uint64(k[:8]) < cutoff
+		if !old && policy.MaxPerUser == 0 {
+			// rest of index is newer
+			return errStopIteration
+		}
+		var entry pyRunIndexEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		switch {
+		case policy.KeepEvaluations && entry.Evaluation:
+		case old:
+			prune = append(prune, k)
+		default:
+			perUser[entry.owner()] = append(perUser[entry.owner()], k)
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return 0, err
+	}
+	if policy.MaxPerUser > 0 {
+		for _, keys := range perUser {
+			if len(keys) > policy.MaxPerUser {
+				prune = append(prune, keys[:len(keys)-policy.MaxPerUser]...)
+			}
+		}
+	}
+	for _, k := range prune {
+		if err = kv.Delete(pyDBUploadBucketName, k[8:]); err != nil {
+			return n, err
+		}
+		if err = kv.Delete(pyDBUploadTimeBucketName, k); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// runPyRunsPruner applies retention policy to stored runs every
+// pyRetention.Interval. Does nothing if no policy is configured.
+func runPyRunsPruner() {
+	if !pyRetention.Enabled() || pyRetention.Interval <= 0 {
+		return
+	}
+	l := App().Logger
+	tick := time.NewTicker(pyRetention.Interval)
+	defer tick.Stop()
+	for range tick.C {
+		var n int
+		err := models.KVUpdate(func(kv models.KV) (err error) {
+			n, err = prunePyRuns(kv, pyRetention, time.Now())
+			return err
+		})
+		if err != nil {
+			l.Errorf("pruning python runs: %s", err)
+			continue
+		}
+		l.Infof("pruned %d python runs", n)
+	}
+}
+
+// PyRunsPrunePost applies retention policy to stored runs immediately. For admins
+func PyRunsPrunePost(c buffalo.Context) error {
+	n, err := prunePyRuns(c.Value("kv").(models.KV), pyRetention, time.Now())
+	if err != nil {
+		return c.Error(500, err)
+	}
+	c.Flash().Add("success", T.Translate(c, "curso-python-runs-pruned", render.Data{"count": n}))
+	return c.Redirect(302, "controlPanelPath()")
+}
@@ -0,0 +1,57 @@
+package actions
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+)
+
+func TestPrunePyRunsPerUser(t *testing.T) {
+	errRollback := errors.New("rollback")
+	now := time.Now()
+	err := models.KVUpdate(func(kv models.KV) error {
+		for _, bucket := range []string{pyDBUploadBucketName, pyDBUploadTimeBucketName} {
+			if err := kv.Clear(bucket); err != nil {
+				return err
+			}
+		}
+		for i, run := range []struct{ key, name, id string }{
+			{"a1", "Ana", "id-a"}, {"b1", "Ana", "id-b"}, {"a2", "Ana", "id-a"}, {"b2", "Ana", "id-b"},
+			{"old1", "Ana", ""}, {"old2", "Ana", ""},
+		} {
+			p := &pythonHandler{UserName: run.name, userID: run.id, Timecode: now.Add(time.Duration(i) * time.Second)}
+			if err := kv.Put(pyDBUploadBucketName, []byte(run.key), []byte("{}")); err != nil {
+				return err
+			}
+			if err := indexPyRun(kv, []byte(run.key), p); err != nil {
+				return err
+			}
+		}
+		// runs were indexed when stored
+		if err := kv.Put(pyDBUploadTimeBucketName, pyRunIndexedKey, []byte{1}); err != nil {
+			return err
+		}
+		n, err := prunePyRuns(kv, pyRetentionPolicy{MaxPerUser: 1}, now)
+		if err != nil {
+			return err
+		}
+		if n != 3 {
+			t.Errorf("got %d runs pruned, want 3", n)
+		}
+		for key, kept := range map[string]bool{"a1": false, "b1": false, "a2": true, "b2": true, "old1": false, "old2": true} {
+			v, err := kv.Get(pyDBUploadBucketName, []byte(key))
+			if err != nil {
+				return err
+			}
+			if (v != nil) != kept {
+				t.Errorf("run %s: got kept %v, want %v", key, v != nil, kept)
+			}
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,515 @@
+package actions
+
+// Runner backends for the python interpreter. A Runner takes
+// source code and stdin and runs it in whatever isolation it
+// provides. New isolation strategies are added by implementing
+// Runner and registering it in init() below. The backend used
+// for student code is chosen with the PY_RUNNER environment variable.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobuffalo/envy"
+)
+
+// Runner runs python code. Returned error is non-nil only
+// if the runner itself failed. Errors in python code are reported
+// through RunResult.Status and RunResult.Output.
+type Runner interface {
+	Run(job *RunJob) (RunResult, error)
+}
+
+// RunLimits are the resource limits enforced on a single run.
+// Zero values mean no limit except for Timeout.
+type RunLimits struct {
+	// Timeout is wall clock time
+	Timeout time.Duration
+	// CPUTime is rounded up to seconds
+	CPUTime time.Duration
+	// Memory is address space size in bytes
+	Memory int64
+	// Processes is max amount of processes for the user running python. Counts threads too
+	Processes int
+	// MaxOutput is max combined stdout+stderr length in bytes. Process is killed once exceeded
+	MaxOutput int
+	// MaxFigures is max amount of matplotlib figures returned. 0 returns none
+	MaxFigures int
+	// MaxFigureSize is max size of a figure in bytes. Larger figures are dropped
+	MaxFigureSize int
+}
+
+// Which limit was exceeded during a run
+const (
+	limitTimeout   = "timeout"
+	limitCPU       = "cpu"
+	limitMemory    = "memory"
+	limitProcesses = "processes"
+	limitOutput    = "output"
+)
+
+// RunJob is the python code to be run and who is running it.
+type RunJob struct {
+	Source   string
+	Input    string
+	UserName string
+	UserID   string
+	Limits   RunLimits
+	// Stdin if not nil is read as the process reads stdin after Input.
+	// Used by interactive runs where stdin is typed while the program runs.
+	Stdin io.Reader
+	// Stream if not nil is called with output as it is produced.
+	// stream is either "stdout" or "stderr". Output is still stored in RunResult.
+	Stream func(stream string, chunk []byte)
+	// Files are placed read-only in the working directory by name
+	Files map[string][]byte
+	// Datasets are paths of read-only files on disk placed in the working
+	// directory by name. They are linked instead of copied. See runDatasets
+	Datasets map[string]string
+	// Cancel if not nil kills the process when closed. Used by interpreter sessions
+	Cancel <-chan struct{}
+}
+
+// RunResult is the result of running a RunJob. Output is the
+// combined stdout and stderr of the process. Limit is the
+// limit which killed the process, if any.
+type RunResult struct {
+	Output  string
+	Status  pyExitStatus
+	Elapsed time.Duration
+	Limit   string
+	// Figures are matplotlib figures open when the program exited
+	Figures []pyFigure
+}
+
+var (
+	pyRunners = make(map[string]Runner)
+	// pyRunner runs user submitted code. Set in init()
+	pyRunner Runner
+	// pyTrustedRunner runs code written by admins such as evaluation solutions
+	pyTrustedRunner Runner
+)
+
+// RegisterRunner makes a Runner available under name so it can be
+// selected with the PY_RUNNER environment variable.
+func RegisterRunner(name string, runner Runner) {
+	if _, dup := pyRunners[name]; dup {
+		panic("python runner registered twice: " + name)
+	}
+	pyRunners[name] = runner
+}
+
+func init() {
+	RegisterRunner("host", hostRunner{})
+	RegisterRunner("gontainer", gontainerRunner{chroot: envy.Get("GONTAINER_FS", "")})
+	RegisterRunner("bwrap", bwrapRunner{bin: envy.Get("PY_BWRAP", "bwrap")})
+
+	// Before PY_RUNNER existed the runner was decided by GONTAINER_FS being set
+	defaultRunner := "host"
+	if envy.Get("GONTAINER_FS", "") != "" {
+		defaultRunner = "gontainer"
+	}
+	name := envy.Get("PY_RUNNER", defaultRunner)
+	runner, ok := pyRunners[name]
+	if !ok {
+		must(fmt.Errorf("PY_RUNNER %q not found. available runners: %s", name, runnerNames()))
+	}
+	pyRunner = runner
+	pyTrustedRunner = pyRunners["host"]
+}
+
+func runnerNames() string {
+	names := make([]string, 0, len(pyRunners))
+	for name := range pyRunners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// execPy starts cmd feeding job.Input through stdin and waits for
+// it to exit, for job.Limits.Timeout to pass or for job.Cancel to be
+// closed, whichever happens first. Timed out or canceled processes
+// and processes which exceed output length are killed.
+func execPy(cmd *exec.Cmd, job *RunJob) (res RunResult, err error) {
+	output := &boundedBuffer{max: job.Limits.MaxOutput}
+	output.onFull = func() { _ = cmd.Process.Kill() }
+	cmd.Stdout, cmd.Stderr = output, output
+	// working directory holds sitecustomize.py. See pyfigures.go
+	cmd.Env = append(os.Environ(), "PYTHONPATH=.", "PYTHONDONTWRITEBYTECODE=1")
+	if job.Stream != nil {
+		cmd.Stdout = streamWriter{w: output, stream: "stdout", fn: job.Stream}
+		cmd.Stderr = streamWriter{w: output, stream: "stderr", fn: job.Stream}
+	}
+	var stdin *os.File
+	if job.Stdin == nil {
+		cmd.Stdin = strings.NewReader(job.Input + "\n")
+	} else {
+		// cmd.Wait waits for io.Reader stdin to be exhausted which
+		// may be never so the process gets a pipe to read from instead
+		var pw *os.File
+		if stdin, pw, err = os.Pipe(); err != nil {
+			return res, err
+		}
+		cmd.Stdin = stdin
+		go func() {
+			if job.Input != "" {
+				_, _ = io.WriteString(pw, job.Input+"\n")
+			}
+			_, _ = io.Copy(pw, job.Stdin)
+			pw.Close()
+		}()
+	}
+	tstart := time.Now()
+	err = cmd.Start()
+	if stdin != nil {
+		// child has its own copy
+		stdin.Close()
+	}
+	if err != nil {
+		return res, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(job.Limits.Timeout)
+	defer timer.Stop()
+	canceled := false
+	select {
+	case <-timer.C:
+		_ = cmd.Process.Kill()
+		<-done
+		res.Status, res.Elapsed, res.Limit = pyTimeout, job.Limits.Timeout, limitTimeout
+	case <-job.Cancel:
+		_ = cmd.Process.Kill()
+		<-done
+		res.Status, res.Elapsed, canceled = pyError, time.Since(tstart), true
+	case waitErr := <-done:
+		res.Status, res.Elapsed = pyOK, time.Since(tstart)
+		if waitErr != nil {
+			res.Status = pyError
+		}
+	}
+	res.Output = output.String()
+	if res.Status == pyError && !canceled {
+		res.Limit = exceededLimit(cmd.ProcessState, output, job.Limits)
+	}
+	return res, nil
+}
+
+// exceededLimit returns which of limits was exceeded by a process
+// which errored or an empty string if no limit was exceeded
+func exceededLimit(state *os.ProcessState, output *boundedBuffer, limits RunLimits) string {
+	out := output.String()
+	switch {
+	case output.Full():
+		return limitOutput
+	case state != nil && exceededCPU(state, limits):
+		return limitCPU
+	case strings.Contains(out, "MemoryError"):
+		return limitMemory
+	case strings.Contains(out, "BlockingIOError") || strings.Contains(out, "can't start new thread"):
+		return limitProcesses
+	}
+	return ""
+}
+
+// boundedBuffer is a concurrency safe io.Writer which stores up to max bytes.
+// Once max is exceeded onFull is called and subsequent writes fail.
+// A boundedBuffer with max==0 has no limit.
+type boundedBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	max    int
+	full   bool
+	onFull func()
+}
+
+var errOutputLimit = errors.New("output limit exceeded")
+
+// streamWriter writes to w and calls fn with what was written
+type streamWriter struct {
+	w      io.Writer
+	stream string
+	fn     func(stream string, chunk []byte)
+}
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if n > 0 {
+		s.fn(s.stream, p[:n])
+	}
+	return n, err
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.full {
+		return 0, errOutputLimit
+	}
+	if b.max > 0 && b.buf.Len()+len(p) > b.max {
+		n, _ := b.buf.Write(p[:b.max-b.buf.Len()])
+		b.full = true
+		if b.onFull != nil {
+			b.onFull()
+		}
+		return n, errOutputLimit
+	}
+	return b.buf.Write(p)
+}
+
+// String returns contents of buffer
+func (b *boundedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Full reports whether writes to buffer exceeded max
+func (b *boundedBuffer) Full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.full
+}
+
+// runFile is a file written to the working directory of a run
+type runFile struct {
+	Name string
+	Data []byte
+	Perm os.FileMode
+	// Path if set is the file linked into the working directory instead of Data
+	Path string
+}
+
+// validRunFileName reports whether name is a plain file name which is not hidden
+func validRunFileName(name string) bool {
+	return name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+// runDir creates a new directory inside parent for a single run and
+// writes files inside it. Every run gets its own directory so concurrent
+// runs of a user never share files. The returned function removes the
+// directory and must be called after the run.
+func runDir(parent, prefix string, files []runFile) (dir string, remove func(), err error) {
+	if err = os.MkdirAll(parent, os.ModeDir|0755); err != nil {
+		return "", nil, fmt.Errorf("creating python workdir: %s", err)
+	}
+	// path separators are not allowed in prefix
+	prefix = strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(prefix)
+	dir, err = ioutil.TempDir(parent, prefix+"-")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating python workdir: %s", err)
+	}
+	remove = func() { _ = os.RemoveAll(dir) }
+	for _, f := range files {
+		if !validRunFileName(f.Name) {
+			remove()
+			return "", nil, fmt.Errorf("invalid run file name %q", f.Name)
+		}
+		if f.Path != "" {
+			err = linkFile(f.Path, filepath.Join(dir, f.Name), f.Perm)
+		} else {
+			err = writeNewFile(filepath.Join(dir, f.Name), f.Data, f.Perm)
+		}
+		if err != nil {
+			remove()
+			return "", nil, err
+		}
+	}
+	return dir, remove, nil
+}
+
+// writeNewFile is as ioutil.WriteFile but fails if file exists
+func writeNewFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// linkFile hard links src to name. The file is copied with perm
+// if it can not be linked, i.e. if src is in another filesystem.
+func linkFile(src, name string, perm os.FileMode) error {
+	if os.Link(src, name) == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeNewFile(name, data, perm)
+}
+
+// runFiles are the files in the working directory of job. job.Files and
+// job.Datasets are read-only. Files replace datasets of the same name.
+func runFiles(job *RunJob) []runFile {
+	files := []runFile{
+		{Name: "f.py", Data: []byte(job.Source), Perm: 0644},
+		{Name: "sitecustomize.py", Data: []byte(siteCustomize(job.Limits)), Perm: 0644},
+	}
+	for name, data := range job.Files {
+		files = append(files, runFile{Name: name, Data: data, Perm: 0444})
+	}
+	for name, path := range job.Datasets {
+		if _, ok := job.Files[name]; !ok {
+			files = append(files, runFile{Name: name, Path: path, Perm: 0444})
+		}
+	}
+	return files
+}
+
+// addFigures sets figures saved in dir to res
+func addFigures(res *RunResult, dir string, limits RunLimits) error {
+	figures, dropped, err := collectFigures(dir, limits)
+	res.Figures = figures
+	if dropped > 0 {
+		res.Output += fmt.Sprintf("\n%d figure(s) larger than %d bytes not shown", dropped, limits.MaxFigureSize)
+	}
+	return err
+}
+
+// hostRunner runs python on the machine python installation.
+// It creates a file in a new directory in tmp/ and runs it from
+// that directory. Offers no isolation whatsoever.
+type hostRunner struct{}
+
+func (hostRunner) Run(job *RunJob) (RunResult, error) {
+	// python reports absolute paths in tracebacks so we use one to be able to trim it
+	parent, err := filepath.Abs("tmp")
+	if err != nil {
+		return RunResult{}, err
+	}
+	dir, remove, err := runDir(parent, job.UserID, runFiles(job))
+	if err != nil {
+		return RunResult{}, err
+	}
+	defer remove()
+	filename := filepath.Join(dir, "f.py")
+	cmd := command(limitArgs(job.Limits, pyArgs(job, filename)...))
+	cmd.Dir = dir
+	res, err := execPy(cmd, job)
+	res.Output = trimRunDir(res.Output, filename, dir)
+	if err == nil {
+		err = addFigures(&res, dir, job.Limits)
+	}
+	return res, err
+}
+
+// trimRunDir removes the path of the program file filename and
+// of other files in the run's directory dir from tracebacks in output
+func trimRunDir(output, filename, dir string) string {
+	output = strings.ReplaceAll(output, "\""+filename+"\",", "")
+	return strings.ReplaceAll(output, "\""+dir+string(filepath.Separator), "\"")
+}
+
+// pyArgs returns the command which runs python file filename.
+// Output of streamed jobs is unbuffered so it is sent as it is printed.
+func pyArgs(job *RunJob, filename string) []string {
+	if job.Stream != nil {
+		return []string{pyCommand, "-u", filename}
+	}
+	return []string{pyCommand, filename}
+}
+
+// command returns an *exec.Cmd which runs argv
+func command(argv []string) *exec.Cmd {
+	return exec.Command(argv[0], argv[1:]...)
+}
+
+// gontainerRunner runs python in a container (only works on linux)
+// thus it is safe from hackers. Can't touch this requires installing
+// github.com/soypat/gontainer in PATH. Also requires setting GONTAINER_FS
+// to the path of the filesystem that will be containerized.
+type gontainerRunner struct {
+	chroot string
+}
+
+func (g gontainerRunner) Run(job *RunJob) (RunResult, error) {
+	if g.chroot == "" {
+		return RunResult{}, fmt.Errorf("GONTAINER_FS environment variable not set. see https://alpinelinux.org/ for a minimal filesystem")
+	}
+	dir, remove, err := runDir(filepath.Join(g.chroot, "home"), job.UserName+"-"+job.UserID[0:5], runFiles(job))
+	if err != nil {
+		return RunResult{}, err
+	}
+	defer remove()
+	userDir := "/home/" + filepath.Base(dir)
+	chrootFilename := filepath.Join(userDir, "f.py")
+	gontainerArgs := []string{"run", "--chdr", userDir, "--chrt", g.chroot,
+		"--timeout", (job.Limits.Timeout + time.Second).String()}
+	gontainerArgs = append(gontainerArgs, limitArgs(job.Limits, pyArgs(job, chrootFilename)...)...)
+	res, err := execPy(exec.Command("gontainer", gontainerArgs...), job)
+	// gontainer does not forward python's exit code so we look for a traceback instead
+	if res.Status != pyTimeout && strings.Contains(res.Output, chrootFilename) {
+		res.Status = pyError
+	}
+	res.Output = trimRunDir(res.Output, chrootFilename, userDir)
+	if err == nil {
+		err = addFigures(&res, dir, job.Limits)
+	}
+	return res, err
+}
+
+// bwrapRunner runs python inside linux namespaces using bubblewrap
+// (https://github.com/containers/bubblewrap). The host's system directories
+// are mounted read-only and the only writable directory is the run's workdir.
+// Network, IPC and PID namespaces are unshared. Does not require root.
+type bwrapRunner struct {
+	bin string
+}
+
+func (b bwrapRunner) Run(job *RunJob) (RunResult, error) {
+	parent, err := filepath.Abs("tmp")
+	if err != nil {
+		return RunResult{}, err
+	}
+	// datasets are mounted read-only instead of linked into the writable
+	// workdir so programs can not chmod and modify the cached files
+	workdir := *job
+	workdir.Datasets = nil
+	dir, remove, err := runDir(parent, job.UserID, runFiles(&workdir))
+	if err != nil {
+		return RunResult{}, err
+	}
+	defer remove()
+	const sandboxDir = "/sandbox"
+	filename := sandboxDir + "/f.py"
+	args := []string{"--unshare-all", "--die-with-parent", "--new-session",
+		"--ro-bind", "/usr", "/usr", "--ro-bind-try", "/lib", "/lib", "--ro-bind-try", "/lib64", "/lib64",
+		"--ro-bind-try", "/bin", "/bin", "--ro-bind-try", "/etc/alternatives", "/etc/alternatives",
+		"--proc", "/proc", "--dev", "/dev", "--tmpfs", "/tmp",
+		"--bind", dir, sandboxDir, "--chdir", sandboxDir}
+	for name, path := range job.Datasets {
+		if _, ok := job.Files[name]; ok {
+			continue
+		}
+		if !validRunFileName(name) {
+			return RunResult{}, fmt.Errorf("invalid run file name %q", name)
+		}
+		args = append(args, "--ro-bind", path, sandboxDir+"/"+name)
+	}
+	args = append(args, limitArgs(job.Limits, pyArgs(job, filename)...)...)
+	res, err := execPy(exec.Command(b.bin, args...), job)
+	res.Output = trimRunDir(res.Output, filename, sandboxDir)
+	if err == nil {
+		err = addFigures(&res, dir, job.Limits)
+	}
+	return res, err
+}
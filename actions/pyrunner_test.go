@@ -0,0 +1,59 @@
+package actions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBoundedBuffer(t *testing.T) {
+	full := 0
+	b := &boundedBuffer{max: 5, onFull: func() { full++ }}
+	if n, err := b.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("write under max: got %d, %v", n, err)
+	}
+	if n, err := b.Write([]byte("defg")); n != 2 || err != errOutputLimit {
+		t.Fatalf("write past max: got %d, %v", n, err)
+	}
+	if n, err := b.Write([]byte("h")); n != 0 || err != errOutputLimit {
+		t.Fatalf("write when full: got %d, %v", n, err)
+	}
+	if b.String() != "abcde" || !b.Full() || full != 1 {
+		t.Errorf("got %q, full %v, onFull called %d times", b.String(), b.Full(), full)
+	}
+
+	b = &boundedBuffer{max: 3}
+	if n, err := b.Write([]byte("abc")); n != 3 || err != nil || b.Full() {
+		t.Errorf("write up to max: got %d, %v, full %v", n, err, b.Full())
+	}
+
+	b = &boundedBuffer{}
+	if _, err := b.Write([]byte(strings.Repeat("a", 1<<16))); err != nil || b.Full() {
+		t.Errorf("buffer without max: got %v, full %v", err, b.Full())
+	}
+}
+
+func TestExceededLimit(t *testing.T) {
+	full := &boundedBuffer{max: 1}
+	_, _ = full.Write([]byte("MemoryError"))
+	for _, test := range []struct {
+		name   string
+		output *boundedBuffer
+		limit  string
+	}{
+		{name: "output", output: full, limit: limitOutput},
+		{name: "memory", output: bufferOf("Traceback (most recent call last):\nMemoryError\n"), limit: limitMemory},
+		{name: "processes", output: bufferOf("BlockingIOError: [Errno 11] Resource temporarily unavailable\n"), limit: limitProcesses},
+		{name: "threads", output: bufferOf("RuntimeError: can't start new thread\n"), limit: limitProcesses},
+		{name: "error", output: bufferOf("ZeroDivisionError: division by zero\n")},
+	} {
+		if limit := exceededLimit(nil, test.output, pyLimits); limit != test.limit {
+			t.Errorf("%s: got limit %q, want %q", test.name, limit, test.limit)
+		}
+	}
+}
+
+func bufferOf(s string) *boundedBuffer {
+	b := &boundedBuffer{}
+	_, _ = b.Write([]byte(s))
+	return b
+}
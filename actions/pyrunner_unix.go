@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package actions
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"syscall"
+	"time"
+)
+
+// limitArgs wraps argv in a shell that sets the resource
+// limits (rlimits) of the process before exec'ing argv.
+// Limits with zero value are not set.
+func limitArgs(limits RunLimits, argv ...string) []string {
+	// openblas (numpy) reserves memory per thread which does not play well with address space limits
+	script := "export OPENBLAS_NUM_THREADS=1"
+	if limits.CPUTime > 0 {
+		script += fmt.Sprintf("; ulimit -t %d", cpuSeconds(limits))
+	}
+	if limits.Memory > 0 {
+		script += fmt.Sprintf("; ulimit -v %d", limits.Memory/1024)
+	}
+	if limits.Processes > 0 {
+		script += fmt.Sprintf("; ulimit -u %d", limits.Processes)
+	}
+	script += `; exec "$@"`
+	return append([]string{"sh", "-c", script, "sh"}, argv...)
+}
+
+// cpuSeconds is the CPU time limit rounded up to seconds as rlimits require
+func cpuSeconds(limits RunLimits) int {
+	return int(math.Ceil(limits.CPUTime.Seconds()))
+}
+
+// exceededCPU reports whether process was killed for exceeding its CPU time limit.
+// Reaching the limit sends SIGXCPU or SIGKILL depending on the kernel. SIGKILL is
+// also sent on timeouts, output limits and by the OOM killer so it only counts if
+// the process used up its CPU time. CPU time is accounted in ticks so processes
+// killed at the limit may report slightly less.
+func exceededCPU(state *os.ProcessState, limits RunLimits) bool {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return false
+	}
+	switch ws.Signal() {
+	case syscall.SIGXCPU:
+		return true
+	case syscall.SIGKILL:
+		limit := time.Duration(cpuSeconds(limits)) * time.Second
+		return limits.CPUTime > 0 && state.UserTime()+state.SystemTime() >= limit*9/10
+	}
+	return false
+}
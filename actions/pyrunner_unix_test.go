@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package actions
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitArgs(t *testing.T) {
+	args := limitArgs(RunLimits{CPUTime: 1500 * time.Millisecond, Memory: 512e6, Processes: 10}, "python3", "f.py")
+	script := args[2]
+	for _, want := range []string{"ulimit -t 2", "ulimit -v 500000", "ulimit -u 10", `exec "$@"`} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script %q does not contain %q", script, want)
+		}
+	}
+	if tail := args[len(args)-2:]; tail[0] != "python3" || tail[1] != "f.py" {
+		t.Errorf("got command %q", tail)
+	}
+	if script = limitArgs(RunLimits{})[2]; strings.Contains(script, "ulimit") {
+		t.Errorf("zero limits set: %q", script)
+	}
+}
+
+func TestExceededCPU(t *testing.T) {
+	limits := RunLimits{CPUTime: time.Second}
+	for _, test := range []struct {
+		name   string
+		script string
+		cpu    bool
+	}{
+		{name: "cpu limit", script: "ulimit -t 1; while :; do :; done", cpu: true},
+		{name: "killed", script: "kill -KILL $$"},
+		{name: "error", script: "exit 1"},
+	} {
+		cmd := exec.Command("sh", "-c", test.script)
+		_ = cmd.Run()
+		if cpu := exceededCPU(cmd.ProcessState, limits); cpu != test.cpu {
+			t.Errorf("%s: got %v, want %v", test.name, cpu, test.cpu)
+		}
+	}
+}
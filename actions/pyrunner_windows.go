@@ -0,0 +1,14 @@
+package actions
+
+import "os"
+
+// limitArgs returns argv as is. Windows does not support rlimits
+// so only timeout and output limits are enforced.
+func limitArgs(limits RunLimits, argv ...string) []string {
+	return argv
+}
+
+// exceededCPU is always false on windows since CPU time is not limited
+func exceededCPU(state *os.ProcessState, limits RunLimits) bool {
+	return false
+}
@@ -0,0 +1,221 @@
+package actions
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// pyRun is a python run stored by PutTx
+type pyRun struct {
+	pythonHandler
+	// Key is the hex encoded storage key
+	Key string
+}
+
+// TotalElapsed is the total time spent running code
+func (r pyRun) TotalElapsed() (total time.Duration) {
+	for _, e := range r.Elapsed {
+		total += e
+	}
+	return total
+}
+
+// pyRunFilter selects stored runs shown to admins. Empty fields do not filter
+type pyRunFilter struct {
+	User       string
+	Evaluation string
+	From       string // 2006-01-02
+	To         string // 2006-01-02, inclusive
+	// Status is "error" or "ok"
+	Status string
+	// Query is searched for in source code
+	Query string
+}
+
+const pyRunDateLayout = "2006-01-02"
+
+// bounds returns the times runs must be stored in, [from, to).
+// Zero times do not bound.
+func (f pyRunFilter) bounds() (from, to time.Time, err error) {
+	if f.From != "" {
+		if from, err = time.Parse(pyRunDateLayout, f.From); err != nil {
+			return from, to, err
+		}
+	}
+	if f.To != "" {
+		if to, err = time.Parse(pyRunDateLayout, f.To); err != nil {
+			return from, to, err
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+// matcher returns function which reports whether a run passes filter
+func (f pyRunFilter) matcher() (func(*pyRun) bool, error) {
+	from, to, err := f.bounds()
+	if err != nil {
+		return nil, err
+	}
+	user := strings.ToLower(f.User)
+	return func(run *pyRun) bool {
+		switch {
+		case user != "" && !strings.Contains(strings.ToLower(run.UserName), user),
+			f.Evaluation != "" && run.Evaluation.String() != f.Evaluation,
+			!from.IsZero() && run.Timecode.Before(from),
+			!to.IsZero() && !run.Timecode.Before(to),
+			f.Status == "error" && run.Error == "",
+			f.Status == "ok" && run.Error != "",
+			f.Query != "" && !strings.Contains(run.Source, f.Query):
+			return false
+		}
+		return true
+	}, nil
+}
+
+// runTime returns the time a run was stored. Runs stored before
+// Timecode was set only have the time as a string.
+func runTime(p *pythonHandler) time.Time {
+	if !p.Timecode.IsZero() {
+		return p.Timecode
+	}
+	// strip monotonic clock reading ("m=+0.001")
+	s := p.Time
+	if i := strings.Index(s, " m="); i > 0 {
+		s = s[:i]
+	}
+	t, _ := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", s)
+	return t
+}
+
+// PyRunsGet lists python runs in storage, most recent first. For admins
+func PyRunsGet(c buffalo.Context) error {
+	tx := c.Value("tx").(*pop.Connection)
+	kv := c.Value("kv").(models.KV)
+	filter := pyRunFilter{User: c.Param("user"), Evaluation: c.Param("evalid"), From: c.Param("from"),
+		To: c.Param("to"), Status: c.Param("status"), Query: c.Param("q")}
+	if filter.Evaluation != "" {
+		if _, err := uuid.FromString(filter.Evaluation); err != nil {
+			return c.Error(400, err)
+		}
+	}
+	match, err := filter.matcher()
+	if err != nil {
+		return c.Error(400, err)
+	}
+	from, to, _ := filter.bounds()
+	if err = ensurePyRunIndex(kv); err != nil {
+		return c.Error(500, err)
+	}
+	page, perPage := setPagination(c.Params(), 20)
+	pagination := pop.NewPaginator(page, perPage)
+	// walk time index newest first a batch of keys at a time until
+	// the page is full and a run for the next page has been found
+	var before []byte
+	if !to.IsZero() {
+		before = pyRunIndexKey(to, nil)
+	}
+	var runs []pyRun
+	skip, more := pagination.Offset, false
+walk:
+	for {
+		var keys [][]byte
+		err = kv.ForEachReverse(pyDBUploadTimeBucketName, before, func(k, _ []byte) error {
+			if len(keys) == perPage+1 {
+				return errStopIteration
+			}
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return c.Error(500, err)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		before = keys[len(keys)-1]
+		for _, k := range keys {
+			if len(k) < 8 {
+				// pyRunIndexedKey
+				continue
+			}
+			if !from.IsZero() && binary.BigEndian.Uint64(k[:8]) < uint64(from.UnixNano()) {
+				// rest of index is older
+				break walk
+			}
+			v, err := kv.Get(pyDBUploadBucketName, k[8:])
+			if err != nil {
+				return c.Error(500, err)
+			}
+			if v == nil {
+				continue
+			}
+			run := pyRun{Key: hex.EncodeToString(k[8:])}
+			if err := json.Unmarshal(v, &run.pythonHandler); err != nil {
+				c.Logger().Errorf("decoding python run %s: %s", run.Key, err)
+				continue
+			}
+			run.Timecode = runTime(&run.pythonHandler)
+			switch {
+			case !match(&run):
+			case skip > 0:
+				skip--
+			case len(runs) == perPage:
+				more = true
+				break walk
+			default:
+				runs = append(runs, run)
+			}
+		}
+	}
+	// runs are only counted up to the current page
+	pagination.TotalEntriesSize = pagination.Offset - skip + len(runs)
+	pagination.TotalPages = page
+	if more {
+		// amount of stored runs is an upper bound of runs matching filter
+		stats, err := kv.Stats(pyDBUploadBucketName)
+		if err != nil {
+			return c.Error(500, err)
+		}
+		pagination.TotalEntriesSize = stats.Keys
+		pagination.TotalPages++
+	}
+	pagination.CurrentEntriesSize = len(runs)
+
+	evals := models.Evaluations{}
+	if err = tx.Order("created_at ASC").All(&evals); err != nil {
+		return errors.WithStack(err)
+	}
+	evalTitles := make(map[string]string, len(evals))
+	for _, e := range evals {
+		evalTitles[e.ID.String()] = deleteXMLTags(e.Title)
+	}
+	c.Set("runs", runs)
+	c.Set("filter", filter)
+	c.Set("evaluations", evals)
+	c.Set("eval_titles", evalTitles)
+	c.Set("pagination", pagination)
+	return c.Render(200, r.HTML("curso/runs.plush.html"))
+}
+
+// PyRunDelete deletes a single python run from storage. For admins
+func PyRunDelete(c buffalo.Context) error {
+	key, err := hex.DecodeString(c.Param("key"))
+	if err != nil {
+		return c.Error(400, err)
+	}
+	if err = deletePyRun(c.Value("kv").(models.KV), key); err != nil {
+		return c.Error(500, err)
+	}
+	c.Flash().Add("success", T.Translate(c, "curso-python-runs-deleted"))
+	return c.Redirect(302, "pyRunsPath()")
+}
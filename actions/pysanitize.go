@@ -0,0 +1,634 @@
+package actions
+
+// Python aware sanitization of user submitted code. Source code
+// is tokenized following python's lexical rules so that checks
+// apply to actual identifiers and imports and not to strings, comments
+// or substrings of harmless names. f-string expressions are
+// tokenized and checked as well.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// pyPolicy are the rules user submitted code must comply with
+type pyPolicy struct {
+	// AllowedImports maps top level module names to whether they may be imported.
+	// Modules not present are not in safelist.
+	AllowedImports map[string]bool
+	// ForbiddenNames may not be used as identifiers, i.e: eval(x)
+	ForbiddenNames map[string]bool
+	// ForbiddenAttrs may not be accessed as attributes or imported by name, i.e: df.to_csv(x)
+	ForbiddenAttrs map[string]bool
+	// AllowedDunders are the only dunder names (__x__) that may be used
+	AllowedDunders map[string]bool
+	// MaxSourceLength is max length of code in bytes
+	MaxSourceLength int
+}
+
+var defaultPyPolicy = pyPolicy{
+	AllowedImports: map[string]bool{
+		"math":       true,
+		"numpy":      true,
+		"pandas":     true,
+		"matplotlib": true,
+		"json":       true,
+		"itertools":  false,
+		"processing": false,
+		"os":         false,
+	},
+	ForbiddenNames: setOf("exec", "eval", "compile", "globals", "locals", "breakpoint", "getattr",
+		"setattr", "delattr", "memoryview", "vars", "super", "open"),
+	ForbiddenAttrs: setOf("write", "writelines",
+		// modules such as pandas import os and subprocess, reachable as attributes
+		"os", "system", "popen", "subprocess",
+		// numpy
+		"tofile", "savetxt", "save", "savez", "savez_compressed", "fromfile", "genfromtxt", "load", "ctypeslib",
+		// json
+		"dump",
+		// pandas
+		"to_csv", "to_json", "to_html", "to_clipboard", "to_excel", "to_hdf", "to_feather", "to_parquet", "to_msgpack",
+		"to_stata", "to_pickle", "to_sql", "to_gbq", "read_pickle", "eval",
+		// matplotlib. figures are saved by the interpreter, see pyfigures.go
+		"savefig", "imsave", "print_figure", "print_png", "print_jpg", "print_jpeg", "print_tif", "print_tiff",
+		"print_webp", "print_raw", "print_rgba", "print_svg", "print_svgz", "print_pdf", "print_ps", "print_eps",
+		"print_pgf", "backend_pdf", "backend_pgf", "backend_ps", "backend_svg", "PdfPages",
+		// matplotlib animations. Animation.save is forbidden above
+		"writers", "MovieWriter", "FileMovieWriter", "AbstractMovieWriter", "FFMpegWriter", "FFMpegFileWriter",
+		"ImageMagickWriter", "ImageMagickFileWriter", "PillowWriter", "HTMLWriter", "saving"),
+	AllowedDunders: setOf("__name__", "__main__", "__init__", "__str__", "__repr__", "__len__", "__eq__", "__ne__",
+		"__lt__", "__le__", "__gt__", "__ge__", "__add__", "__sub__", "__mul__", "__truediv__", "__iter__",
+		"__next__", "__getitem__", "__setitem__", "__contains__", "__hash__", "__bool__"),
+	MaxSourceLength: pyMaxSourceLength,
+}
+
+func setOf(elems ...string) map[string]bool {
+	set := make(map[string]bool, len(elems))
+	for _, e := range elems {
+		set[e] = true
+	}
+	return set
+}
+
+// pyCodeError is an error in user code at a given position.
+// Line and Col start at 1.
+type pyCodeError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (e *pyCodeError) Error() string {
+	return fmt.Sprintf("line %d, col %d: %s", e.Line, e.Col, e.Msg)
+}
+
+// check returns first violation of the policy found in src
+func (pol *pyPolicy) check(src string) error {
+	if len(src) > pol.MaxSourceLength {
+		return fmt.Errorf("code snippet too long (%d/%d)", len(src), pol.MaxSourceLength)
+	}
+	if err := checkCoding(src); err != nil {
+		return err
+	}
+	toks, err := tokenizePy(src)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(toks); i++ {
+		if toks[i].Kind != pyName {
+			continue
+		}
+		switch {
+		case toks[i].Value == "import":
+			i, err = pol.checkImport(toks, i)
+		case toks[i].Value == "from" && stmtStart(toks, i):
+			i, err = pol.checkFromImport(toks, i)
+		default:
+			err = pol.checkName(toks, i)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pyCodingRx matches a PEP 263 source encoding declaration
+var pyCodingRx = regexp.MustCompile(`^[ \t\f]*#.*?coding[:=][ \t]*([-\w.]+)`)
+
+// checkCoding rejects source encoding declarations other than utf-8.
+// Python decodes source with the declared encoding before tokenizing it
+// so code hidden in comments, i.e. with unicode_escape, would run unchecked.
+func checkCoding(src string) error {
+	lines := strings.SplitN(strings.TrimPrefix(src, "\ufeff"), "\n", 3)
+	for i := 0; i < len(lines) && i < 2; i++ {
+		m := pyCodingRx.FindStringSubmatch(lines[i])
+		if m == nil {
+			continue
+		}
+		enc := strings.ReplaceAll(strings.ToLower(m[1]), "_", "-")
+		if enc != "utf-8" && enc != "utf8" && !strings.HasPrefix(enc, "utf-8-") {
+			return &pyCodeError{Line: i + 1, Col: 1, Msg: fmt.Sprintf("forbidden source encoding '%s'", m[1])}
+		}
+	}
+	return nil
+}
+
+// checkName checks identifier at toks[i]
+func (pol *pyPolicy) checkName(toks []pyToken, i int) error {
+	tok := toks[i]
+	isAttr := i > 0 && toks[i-1].is(pyOp, ".")
+	switch {
+	case isAttr && pol.ForbiddenAttrs[tok.Value]:
+		return tok.errorf("forbidden attribute '%s'", tok.Value)
+	case !isAttr && pol.ForbiddenNames[tok.Value]:
+		return tok.errorf("forbidden name '%s'", tok.Value)
+	case isDunder(tok.Value) && !pol.AllowedDunders[tok.Value]:
+		return tok.errorf("forbidden dunder name '%s'", tok.Value)
+	}
+	return nil
+}
+
+// checkModule checks dotted module name starting at toks[i]. Returns
+// index of last token of module name.
+func (pol *pyPolicy) checkModule(toks []pyToken, i int) (int, error) {
+	if i >= len(toks) || toks[i].Kind != pyName {
+		return i, toks[i-1].errorf("invalid import syntax")
+	}
+	root := toks[i]
+	allowed, present := pol.AllowedImports[root.Value]
+	if !present {
+		return i, root.errorf("import '%s' not in safelist:\n%s", root.Value, pol.safeList())
+	}
+	if !allowed {
+		return i, root.errorf("forbidden import '%s'", root.Value)
+	}
+	for i+2 < len(toks) && toks[i+1].is(pyOp, ".") && toks[i+2].Kind == pyName {
+		i += 2
+		if err := pol.checkName(toks, i); err != nil {
+			return i, err
+		}
+	}
+	return i, nil
+}
+
+// checkImport checks `import a.b as c, d` statement starting at toks[i].
+// Returns index of last token of statement.
+func (pol *pyPolicy) checkImport(toks []pyToken, i int) (_ int, err error) {
+	for {
+		if i, err = pol.checkModule(toks, i+1); err != nil {
+			return i, err
+		}
+		if i+2 < len(toks) && toks[i+1].is(pyName, "as") {
+			i += 2
+			if err = pol.checkName(toks, i); err != nil {
+				return i, err
+			}
+		}
+		if i+1 >= len(toks) || !toks[i+1].is(pyOp, ",") {
+			return i, nil
+		}
+		i++
+	}
+}
+
+// checkFromImport checks `from a.b import (c as d, e)` statement starting at toks[i].
+// Returns index of last token of statement.
+func (pol *pyPolicy) checkFromImport(toks []pyToken, i int) (_ int, err error) {
+	if i+1 < len(toks) && (toks[i+1].is(pyOp, ".") || toks[i+1].is(pyOp, "...")) {
+		return i, toks[i+1].errorf("relative imports not allowed")
+	}
+	if i, err = pol.checkModule(toks, i+1); err != nil {
+		return i, err
+	}
+	i++
+	if i >= len(toks) || !toks[i].is(pyName, "import") {
+		return i, toks[i-1].errorf("invalid import syntax")
+	}
+	for i++; i < len(toks); i++ {
+		tok := toks[i]
+		switch {
+		case tok.is(pyOp, "*"):
+			return i, tok.errorf("wildcard imports not allowed. import names explicitly")
+		case tok.Kind == pyName && tok.Value != "as":
+			if pol.ForbiddenAttrs[tok.Value] || pol.ForbiddenNames[tok.Value] {
+				return i, tok.errorf("forbidden import name '%s'", tok.Value)
+			}
+			if err = pol.checkName(toks, i); err != nil {
+				return i, err
+			}
+		case tok.Kind == pyNewline || tok.is(pyOp, ";"):
+			return i, nil
+		}
+	}
+	return i, nil
+}
+
+// safeList shows user what imports can
+// be used in interpreter
+func (pol *pyPolicy) safeList() string {
+	var mods []string
+	for k, v := range pol.AllowedImports {
+		if v {
+			mods = append(mods, k)
+		}
+	}
+	sort.Strings(mods)
+	return strings.Join(mods, ",  ")
+}
+
+// stmtStart reports whether toks[i] is the first token of a statement
+func stmtStart(toks []pyToken, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev := toks[i-1]
+	return prev.Kind == pyNewline || prev.Kind == pyIndent || prev.Kind == pyDedent ||
+		prev.is(pyOp, ";") || prev.is(pyOp, ":")
+}
+
+// pyImports returns the top level modules imported by src.
+// Returns nil if src can not be tokenized.
+func pyImports(src string) map[string]bool {
+	toks, err := tokenizePy(src)
+	if err != nil {
+		return nil
+	}
+	imports := make(map[string]bool)
+	inImport := false
+	for i := 0; i+1 < len(toks); i++ {
+		tok, next := toks[i], toks[i+1]
+		if tok.Kind == pyNewline || tok.is(pyOp, ";") {
+			inImport = false
+		}
+		if next.Kind != pyName {
+			continue
+		}
+		switch {
+		case tok.is(pyName, "from") && stmtStart(toks, i):
+			imports[next.Value] = true
+		case tok.is(pyName, "import") && stmtStart(toks, i):
+			inImport = true
+			imports[next.Value] = true
+		case inImport && tok.is(pyOp, ","):
+			imports[next.Value] = true
+		}
+	}
+	return imports
+}
+
+func isDunder(name string) bool {
+	return len(name) > 4 && strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__")
+}
+
+type pyTokenKind int
+
+const (
+	pyName pyTokenKind = iota
+	pyNumber
+	pyString
+	pyOp
+	pyNewline
+	pyIndent
+	pyDedent
+)
+
+// pyToken is a python token. Line and Col start at 1.
+// Names are NFKC normalized as python does.
+type pyToken struct {
+	Kind      pyTokenKind
+	Value     string
+	Line, Col int
+}
+
+func (t pyToken) is(kind pyTokenKind, value string) bool {
+	return t.Kind == kind && t.Value == value
+}
+
+func (t pyToken) errorf(format string, a ...interface{}) error {
+	return &pyCodeError{Line: t.Line, Col: t.Col, Msg: fmt.Sprintf(format, a...)}
+}
+
+// python operators and delimiters sorted by length so longest match is found first
+var pyOperators = []string{"**=", "//=", ">>=", "<<=", "...",
+	"**", "//", "<<", ">>", "<=", ">=", "==", "!=", "->", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "@=", ":=",
+	"+", "-", "*", "/", "%", "@", "&", "|", "^", "~", "<", ">", "(", ")", "[", "]", "{", "}", ",", ":", ";", ".", "="}
+
+var pyClosingBracket = map[rune]rune{')': '(', ']': '[', '}': '{'}
+
+// pyTokenizer splits python source into tokens. Newlines
+// inside brackets and escaped newlines are ignored like python does.
+// Lenient tokenizers are used for f-string expressions and do not
+// fail on unknown characters or unbalanced brackets.
+type pyTokenizer struct {
+	src       []rune
+	pos, end  int
+	line, col int
+	lenient   bool
+	brackets  []pyToken
+	indents   []int
+	lineStart bool
+	toks      []pyToken
+}
+
+// tokenizePy returns tokens of python source code. Comments are discarded.
+func tokenizePy(src string) ([]pyToken, error) {
+	runes := []rune(src)
+	t := &pyTokenizer{src: runes, end: len(runes), line: 1, col: 1, indents: []int{0}, lineStart: true}
+	return t.tokenize()
+}
+
+func (t *pyTokenizer) peek(offset int) rune {
+	if t.pos+offset >= t.end {
+		return 0
+	}
+	return t.src[t.pos+offset]
+}
+
+func (t *pyTokenizer) advance() {
+	if t.src[t.pos] == '\n' {
+		t.line++
+		t.col = 0
+	}
+	t.pos++
+	t.col++
+}
+
+func (t *pyTokenizer) emit(kind pyTokenKind, value string, line, col int) {
+	t.toks = append(t.toks, pyToken{Kind: kind, Value: value, Line: line, Col: col})
+}
+
+func (t *pyTokenizer) errorf(format string, a ...interface{}) error {
+	return &pyCodeError{Line: t.line, Col: t.col, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (t *pyTokenizer) lastIsNewline() bool {
+	return len(t.toks) == 0 || t.toks[len(t.toks)-1].Kind == pyNewline
+}
+
+func (t *pyTokenizer) tokenize() ([]pyToken, error) {
+	for t.pos < t.end {
+		if t.lineStart && !t.lenient && len(t.brackets) == 0 {
+			if err := t.indentation(); err != nil {
+				return nil, err
+			}
+			if t.pos >= t.end {
+				break
+			}
+		}
+		r := t.src[t.pos]
+		var err error
+		switch {
+		case r == '\n':
+			if len(t.brackets) == 0 && !t.lenient {
+				if !t.lastIsNewline() {
+					t.emit(pyNewline, "", t.line, t.col)
+				}
+				t.lineStart = true
+			}
+			t.advance()
+		case r == ' ' || r == '\t' || r == '\f' || r == '\r':
+			t.advance()
+		case r == '#':
+			for t.pos < t.end && t.src[t.pos] != '\n' {
+				t.advance()
+			}
+		case r == '\\':
+			t.advance()
+			if t.peek(0) == '\r' {
+				t.advance()
+			}
+			if t.peek(0) != '\n' {
+				return nil, t.errorf("unexpected character after line continuation character")
+			}
+			t.advance()
+		case r == '_' || unicode.IsLetter(r):
+			err = t.name()
+		case unicode.IsDigit(r) || r == '.' && unicode.IsDigit(t.peek(1)):
+			t.number()
+		case r == '"' || r == '\'':
+			err = t.str("", t.line, t.col)
+		default:
+			err = t.operator()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.lenient {
+		return t.toks, nil
+	}
+	if len(t.brackets) > 0 {
+		open := t.brackets[len(t.brackets)-1]
+		return nil, open.errorf("'%s' was never closed", open.Value)
+	}
+	if !t.lastIsNewline() {
+		t.emit(pyNewline, "", t.line, t.col)
+	}
+	for len(t.indents) > 1 {
+		t.indents = t.indents[:len(t.indents)-1]
+		t.emit(pyDedent, "", t.line, t.col)
+	}
+	return t.toks, nil
+}
+
+// indentation consumes leading whitespace of a line and emits INDENT/DEDENT tokens.
+// Blank and comment only lines are ignored.
+func (t *pyTokenizer) indentation() error {
+	width := 0
+	for ; t.pos < t.end && strings.ContainsRune(" \t\f\r", t.src[t.pos]); t.advance() {
+		switch t.src[t.pos] {
+		case ' ':
+			width++
+		case '\t':
+			width += 8 - width%8
+		}
+	}
+	if t.pos >= t.end || t.src[t.pos] == '\n' || t.src[t.pos] == '#' {
+		return nil
+	}
+	t.lineStart = false
+	current := t.indents[len(t.indents)-1]
+	if width > current {
+		t.indents = append(t.indents, width)
+		t.emit(pyIndent, "", t.line, t.col)
+		return nil
+	}
+	for width < t.indents[len(t.indents)-1] {
+		t.indents = t.indents[:len(t.indents)-1]
+		t.emit(pyDedent, "", t.line, t.col)
+	}
+	if width != t.indents[len(t.indents)-1] {
+		return t.errorf("unindent does not match any outer indentation level")
+	}
+	return nil
+}
+
+func (t *pyTokenizer) name() error {
+	line, col, start := t.line, t.col, t.pos
+	for t.pos < t.end {
+		r := t.src[t.pos]
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.In(r, unicode.Mn, unicode.Mc, unicode.Pc) {
+			break
+		}
+		t.advance()
+	}
+	name := string(t.src[start:t.pos])
+	if q := t.peek(0); q == '"' || q == '\'' {
+		switch strings.ToLower(name) {
+		case "r", "u", "b", "f", "br", "rb", "fr", "rf":
+			return t.str(name, line, col)
+		}
+	}
+	t.emit(pyName, norm.NFKC.String(name), line, col)
+	return nil
+}
+
+func (t *pyTokenizer) number() {
+	line, col, start := t.line, t.col, t.pos
+	for t.pos < t.end {
+		r := t.src[t.pos]
+		isExp := (r == 'e' || r == 'E') && (t.peek(1) == '+' || t.peek(1) == '-') &&
+			!strings.HasPrefix(strings.ToLower(string(t.src[start:t.pos])), "0x")
+		if isExp {
+			t.advance()
+		} else if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		t.advance()
+	}
+	t.emit(pyNumber, string(t.src[start:t.pos]), line, col)
+}
+
+// str consumes string literal after prefix. f-string expressions
+// are tokenized and their tokens emitted after the string token. Tokens
+// of each replacement field are enclosed in braces so format spec colons
+// and the rest of the field read as part of a bracketed expression.
+func (t *pyTokenizer) str(prefix string, line, col int) error {
+	start := t.pos - len([]rune(prefix))
+	quote := t.src[t.pos]
+	triple := t.peek(1) == quote && t.peek(2) == quote
+	delim := 1
+	if triple {
+		delim = 3
+	}
+	for i := 0; i < delim; i++ {
+		t.advance()
+	}
+	isF := strings.ContainsAny(prefix, "fF")
+	var exprToks []pyToken
+	for {
+		if t.pos >= t.end {
+			if triple {
+				return pyToken{Line: line, Col: col}.errorf("unterminated triple-quoted string literal")
+			}
+			return pyToken{Line: line, Col: col}.errorf("unterminated string literal")
+		}
+		r := t.src[t.pos]
+		switch {
+		case r == '\\':
+			t.advance()
+			if t.pos < t.end {
+				t.advance()
+			}
+			continue
+		case r == '\n' && !triple:
+			return pyToken{Line: line, Col: col}.errorf("unterminated string literal")
+		case r == quote && (!triple || t.peek(1) == quote && t.peek(2) == quote):
+			for i := 0; i < delim; i++ {
+				t.advance()
+			}
+			t.emit(pyString, string(t.src[start:t.pos]), line, col)
+			t.toks = append(t.toks, exprToks...)
+			return nil
+		case isF && r == '{' && t.peek(1) == '{':
+			t.advance()
+		case isF && r == '{':
+			open := pyToken{Kind: pyOp, Value: "{", Line: t.line, Col: t.col}
+			toks, err := t.fexpr(quote, triple)
+			if err != nil {
+				return err
+			}
+			exprToks = append(exprToks, open)
+			exprToks = append(exprToks, toks...)
+			exprToks = append(exprToks, pyToken{Kind: pyOp, Value: "}", Line: t.line, Col: t.col - 1})
+			continue
+		}
+		t.advance()
+	}
+}
+
+// fexpr consumes an f-string replacement field starting
+// at '{' and returns the tokens of the expression inside it.
+// Format specs are tokenized along with the expression since they may contain nested fields.
+func (t *pyTokenizer) fexpr(quote rune, triple bool) ([]pyToken, error) {
+	t.advance()
+	sub := &pyTokenizer{src: t.src, pos: t.pos, line: t.line, col: t.col, lenient: true}
+	depth := 1
+	for depth > 0 {
+		closesString := t.pos < t.end && t.src[t.pos] == quote && (!triple || t.peek(1) == quote && t.peek(2) == quote)
+		if t.pos >= t.end || closesString {
+			return nil, t.errorf("f-string: expecting '}'")
+		}
+		switch r := t.src[t.pos]; r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '\'', '"':
+			// nested string literal inside expression
+			t.advance()
+			for t.pos < t.end && t.src[t.pos] != r && t.src[t.pos] != '\n' {
+				t.advance()
+			}
+		}
+		if t.pos < t.end {
+			t.advance()
+		}
+	}
+	sub.end = t.pos - 1
+	return sub.tokenize()
+}
+
+func (t *pyTokenizer) operator() error {
+	line, col := t.line, t.col
+	for _, op := range pyOperators {
+		n := len(op)
+		if t.pos+n > t.end || string(t.src[t.pos:t.pos+n]) != op {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			t.advance()
+		}
+		tok := pyToken{Kind: pyOp, Value: op, Line: line, Col: col}
+		if t.lenient {
+			t.toks = append(t.toks, tok)
+			return nil
+		}
+		switch r := []rune(op)[0]; {
+		case n == 1 && strings.ContainsRune("([{", r):
+			t.brackets = append(t.brackets, tok)
+		case n == 1 && strings.ContainsRune(")]}", r):
+			if len(t.brackets) == 0 {
+				return tok.errorf("unmatched '%s'", op)
+			}
+			open := t.brackets[len(t.brackets)-1]
+			if open.Value != string(pyClosingBracket[r]) {
+				return tok.errorf("closing parenthesis '%s' does not match opening parenthesis '%s' on line %d", op, open.Value, open.Line)
+			}
+			t.brackets = t.brackets[:len(t.brackets)-1]
+		}
+		t.toks = append(t.toks, tok)
+		return nil
+	}
+	if t.lenient {
+		t.emit(pyOp, string(t.src[t.pos]), line, col)
+		t.advance()
+		return nil
+	}
+	return t.errorf("invalid character '%c' (U+%04X)", t.src[t.pos], t.src[t.pos])
+}
@@ -0,0 +1,69 @@
+package actions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPyPolicyCheck(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		src  string
+		// err is a substring of the violation, empty if the code is allowed
+		err string
+	}{
+		{name: "valid", src: "import math\nprint(math.sqrt(2))\n"},
+		{name: "allowed aliases", src: "import numpy as np\nimport matplotlib.pyplot as plt\nfrom pandas import DataFrame as DF\n"},
+		{name: "multi-line import", src: "from math import (\n    sqrt,\n    pi as PI,\n)\nprint(sqrt(PI))\n"},
+		{name: "strings and comments", src: "s = 'import os; eval(x)'  # __import__('os')\nprint(s)\n"},
+		{name: "forbidden name substring", src: "evaluate = 1\nprint(evaluate)\n"},
+		{name: "allowed dunders", src: "class A:\n    def __init__(self):\n        self.x = 1\n\n    def __repr__(self):\n        return 'A'\n"},
+		{name: "f-string", src: "n = 3\nprint(f\"{n:>4} {'a'} {{eval}}\")\n"},
+		{name: "__import__", src: "os = __import__('os')\n", err: "forbidden dunder name '__import__'"},
+		{name: "importlib", src: "import importlib\n", err: "import 'importlib' not in safelist"},
+		{name: "forbidden import", src: "import os\n", err: "forbidden import 'os'"},
+		{name: "forbidden import in list", src: "import numpy as np, os\n", err: "forbidden import 'os'"},
+		{name: "forbidden from import", src: "from os import path\n", err: "forbidden import 'os'"},
+		{name: "relative import", src: "from . import f\n", err: "relative imports not allowed"},
+		{name: "wildcard import", src: "from numpy import *\n", err: "wildcard imports not allowed"},
+		{name: "forbidden import name", src: "from numpy import save as s\n", err: "forbidden import name 'save'"},
+		{name: "forbidden name in multi-line import", src: "from math import (\n    sqrt,\n    eval,\n)\n", err: "forbidden import name 'eval'"},
+		{name: "alias to forbidden name", src: "import math as eval\n", err: "forbidden name 'eval'"},
+		{name: "import dunder alias", src: "import math as __builtins__\n", err: "forbidden dunder name '__builtins__'"},
+		{name: "dunder attribute", src: "print(().__class__.__bases__)\n", err: "forbidden dunder name '__class__'"},
+		{name: "dunder attribute of alias", src: "import math as m\nprint(m.__dict__)\n", err: "forbidden dunder name '__dict__'"},
+		{name: "getattr", src: "import math\nf = getattr(math, 'sqrt')\n", err: "forbidden name 'getattr'"},
+		{name: "f-string call", src: "print(f\"{eval('1')}\")\n", err: "forbidden name 'eval'"},
+		{name: "f-string dunder", src: "x = 1\nprint(f\"{x.__class__!r:>10}\")\n", err: "forbidden dunder name '__class__'"},
+		{name: "nested f-string", src: "print(f\"{f'{eval}'}\")\n", err: "forbidden name 'eval'"},
+		{name: "forbidden attribute", src: "import pandas as pd\npd.DataFrame().to_csv('x.csv')\n", err: "forbidden attribute 'to_csv'"},
+		{name: "savefig", src: "import matplotlib.pyplot as plt\nplt.savefig('x.png')\n", err: "forbidden attribute 'savefig'"},
+		{name: "canvas print", src: "import matplotlib.pyplot as plt\nplt.gcf().canvas.print_png('x.png')\n", err: "forbidden attribute 'print_png'"},
+		{name: "PdfPages", src: "from matplotlib.backends.backend_pdf import PdfPages\n", err: "forbidden attribute 'backend_pdf'"},
+		{name: "animation writer", src: "from matplotlib import animation\nw = animation.FFMpegWriter()\n", err: "forbidden attribute 'FFMpegWriter'"},
+		{name: "animation save", src: "from matplotlib import animation\na = animation.FuncAnimation(None, None)\na.save('x.gif')\n", err: "forbidden attribute 'save'"},
+		{name: "os through module", src: "import pandas as pd\npd.io.common.os.system('ls')\n", err: "forbidden attribute 'os'"},
+		{name: "os imported from module", src: "from pandas.io.common import os\n", err: "forbidden import name 'os'"},
+		{name: "system", src: "import numpy as np\nnp.system('ls')\n", err: "forbidden attribute 'system'"},
+		{name: "popen", src: "import numpy as np\nnp.popen('ls')\n", err: "forbidden attribute 'popen'"},
+		{name: "subprocess", src: "import pandas as pd\npd.subprocess.run(['ls'])\n", err: "forbidden attribute 'subprocess'"},
+		{name: "open", src: "f = open('notas.csv')\n", err: "forbidden name 'open'"},
+		{name: "utf-8 coding", src: "# -*- coding: utf-8 -*-\nprint(1)\n"},
+		{name: "utf8 coding", src: "#!/usr/bin/env python3\n# coding=UTF_8\nprint(1)\n"},
+		{name: "coding after line 2", src: "print(1)\n\n# coding: latin-1\n"},
+		{name: "unicode_escape coding", src: "# coding: unicode_escape\n#\\u000aimport os\\u000aos.system('echo PWNED')\n",
+			err: "forbidden source encoding 'unicode_escape'"},
+		{name: "coding on line 2", src: "#!/usr/bin/env python3\n# vim: set fileencoding=latin-1 :\nprint(1)\n",
+			err: "forbidden source encoding 'latin-1'"},
+		{name: "coding after BOM", src: "\ufeff# coding: raw_unicode_escape\nprint(1)\n", err: "forbidden source encoding"},
+		{name: "too long", src: strings.Repeat("#", pyMaxSourceLength+1), err: "code snippet too long"},
+	} {
+		err := defaultPyPolicy.check(test.src)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package actions
+
+// Interpreter sessions keep a python process alive per user so
+// variables defined in a cell are available to the next one, as in
+// a notebook. The process runs pySessionDriver which reads cells as
+// JSON lines from stdin, runs them in a persistent namespace and
+// writes a marker line after each cell's output. Cells are sanitized
+// like any other code.
+//
+// Sessions do not use the worker pool since they live for minutes.
+// Instead at most PY_SESSIONS_MAX sessions may be alive at once and
+// each one is killed after PY_SESSION_IDLE_TIMEOUT without cells.
+// CPU time, memory and output limits apply to the session as a whole.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	// time given to an interrupted cell to stop before the session is killed
+	pySessionInterruptGrace = 2 * time.Second
+)
+
+// Set in init()
+var (
+	pySessionsMax        int
+	pySessionIdleTimeout time.Duration
+	pySessionCellTimeout time.Duration
+	pySessionLimits      RunLimits
+)
+
+func init() {
+	var err error
+	pySessionsMax, err = strconv.Atoi(envy.Get("PY_SESSIONS_MAX", "8"))
+	must(err)
+	pySessionIdleTimeout, err = time.ParseDuration(envy.Get("PY_SESSION_IDLE_TIMEOUT", "10m"))
+	must(err)
+	pySessionCellTimeout, err = time.ParseDuration(envy.Get("PY_SESSION_CELL_TIMEOUT", "10s"))
+	must(err)
+	pySessionLimits = pyLimits
+	pySessionLimits.Timeout, err = time.ParseDuration(envy.Get("PY_SESSION_MAX_LIFETIME", "1h"))
+	must(err)
+	pySessionLimits.CPUTime, err = time.ParseDuration(envy.Get("PY_SESSION_MAX_CPU", "60s"))
+	must(err)
+	memMB, err := strconv.Atoi(envy.Get("PY_SESSION_MAX_MEMORY", strconv.Itoa(int(pyLimits.Memory/1e6))))
+	must(err)
+	pySessionLimits.Memory = int64(memMB) * 1e6
+	pySessionLimits.MaxOutput, err = strconv.Atoi(envy.Get("PY_SESSION_MAX_OUTPUT", "1048576"))
+	must(err)
+}
+
+// pySessionDriver runs cells in a persistent namespace. {token} is
+// replaced by a random token so cell output can't be mistaken for
+// the marker which ends it.
+const pySessionDriver = `# Interpreter session driver. Runs cells received through stdin.
+import io
+import json
+import os
+import queue
+import signal
+import sys
+import threading
+import traceback
+
+_marker = "\x1e{token}:"
+_stdin = sys.stdin
+_cells = queue.Queue()
+_running = False
+
+
+def _read():
+    for line in _stdin:
+        msg = json.loads(line)
+        if msg["op"] == "cell":
+            _cells.put(msg)
+        elif msg["op"] == "interrupt" and _running:
+            os.kill(os.getpid(), signal.SIGINT)
+    _cells.put(None)
+
+
+def _sigint(signum, frame):
+    if _running:
+        raise KeyboardInterrupt
+
+
+def _print_exception(e):
+    # frames of this driver are not shown
+    frames = [f for f in traceback.extract_tb(e.__traceback__) if f.filename != __file__]
+    out = sys.__stdout__
+    if frames:
+        out.write("Traceback (most recent call last):\n" + "".join(traceback.format_list(frames)))
+    out.write("".join(traceback.format_exception_only(type(e), e)))
+
+
+def _main():
+    global _running
+    signal.signal(signal.SIGINT, _sigint)
+    threading.Thread(target=_read, daemon=True).start()
+    # single stream keeps tracebacks in order with output
+    sys.stderr = sys.stdout
+    ns = {"__name__": "__main__", "__builtins__": __builtins__}
+    n = 0
+    while True:
+        msg = _cells.get()
+        if msg is None:
+            return
+        n += 1
+        sys.stdin = io.StringIO(msg.get("stdin", ""))
+        ok = True
+        try:
+            _running = True
+            exec(compile(msg["code"], "<celda %d>" % n, "exec"), ns)
+        except BaseException as e:
+            ok = False
+            _print_exception(e)
+        finally:
+            _running = False
+        sys.stdout.flush()
+        sys.__stdout__.write(_marker + json.dumps({"ok": ok, "cell": n}) + "\n")
+        sys.__stdout__.flush()
+
+
+_main()
+`
+
+// pySessionCellStatus is written by the driver after each cell
+type pySessionCellStatus struct {
+	OK   bool `json:"ok"`
+	Cell int  `json:"cell"`
+}
+
+var (
+	errPySessionBusy   = errors.New("a cell is already running in this session")
+	errPySessionClosed = errors.New("session closed")
+)
+
+// pySession is a live python process of a user
+type pySession struct {
+	userID uuid.UUID
+	marker []byte
+	stdin  *io.PipeWriter
+	// stdinR is closed when python exits so writes to stdin do not block
+	stdinR *io.PipeReader
+	cancel chan struct{}
+	idle   *time.Timer
+	// done is closed when python exits. exitErr says why
+	done      chan struct{}
+	exitErr   error
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	busy bool
+	// pending is output which may be the start of a marker
+	pending []byte
+	// out is the output of the running cell
+	out       bytes.Buffer
+	truncated bool
+	status    chan pySessionCellStatus
+}
+
+var pySessions = struct {
+	sync.Mutex
+	m map[uuid.UUID]*pySession
+}{m: make(map[uuid.UUID]*pySession)}
+
+// getPySession returns the user's live session or nil
+func getPySession(userID uuid.UUID) *pySession {
+	pySessions.Lock()
+	defer pySessions.Unlock()
+	return pySessions.m[userID]
+}
+
+// startPySession returns the user's live session, starting one if
+// there is none. Returns nil if PY_SESSIONS_MAX sessions are alive.
+func startPySession(userID uuid.UUID, p *pythonHandler) (*pySession, error) {
+	pySessions.Lock()
+	defer pySessions.Unlock()
+	if s := pySessions.m[userID]; s != nil {
+		return s, nil
+	}
+	if len(pySessions.m) >= pySessionsMax {
+		return nil, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+	pr, pw := io.Pipe()
+	s := &pySession{
+		userID: userID,
+		marker: []byte("\x1e" + token + ":"),
+		stdin:  pw,
+		stdinR: pr,
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+		status: make(chan pySessionCellStatus, 1),
+	}
+	s.idle = time.AfterFunc(pySessionIdleTimeout, s.close)
+	pySessions.m[userID] = s
+	job := &RunJob{
+		Source:   strings.ReplaceAll(pySessionDriver, "{token}", token),
+		UserName: p.UserName,
+		UserID:   p.userID,
+		Limits:   pySessionLimits,
+		Stdin:    pr,
+		Stream:   s.write,
+		Datasets: p.datasets,
+		Cancel:   s.cancel,
+	}
+	go func() {
+		res, err := pyRunner.Run(job)
+		s.exitErr = sessionExitError(res, err)
+		s.stdinR.Close()
+		close(s.done)
+		s.close()
+	}()
+	return s, nil
+}
+
+// sessionExitError describes why a session's python process exited
+func sessionExitError(res RunResult, err error) error {
+	if err != nil {
+		return fmt.Errorf("server error running python: %s", err)
+	}
+	switch res.Limit {
+	case limitTimeout:
+		return fmt.Errorf("session exceeded max lifetime (%s)", pySessionLimits.Timeout)
+	case limitCPU:
+		return fmt.Errorf("session exceeded CPU time limit (%s)", pySessionLimits.CPUTime)
+	case limitMemory:
+		return fmt.Errorf("session exceeded memory limit (%dMB)", pySessionLimits.Memory/1e6)
+	case limitProcesses:
+		return fmt.Errorf("session exceeded process limit (%d)", pySessionLimits.Processes)
+	case limitOutput:
+		return fmt.Errorf("session output exceeded %d bytes", pySessionLimits.MaxOutput)
+	}
+	return errPySessionClosed
+}
+
+// close kills the session's process and forgets the session
+func (s *pySession) close() {
+	s.closeOnce.Do(func() {
+		s.idle.Stop()
+		close(s.cancel)
+		s.stdin.Close()
+		pySessions.Lock()
+		if pySessions.m[s.userID] == s {
+			delete(pySessions.m, s.userID)
+		}
+		pySessions.Unlock()
+	})
+}
+
+// write receives python's output. Output is stored for the running
+// cell until a marker line is found, which ends the cell.
+func (s *pySession) write(_ string, chunk []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, chunk...)
+	for {
+		i := bytes.Index(s.pending, s.marker)
+		if i < 0 {
+			// hold back output which may be the start of a marker
+			keep := bytes.LastIndexByte(s.pending, s.marker[0])
+			if keep < 0 || len(s.pending)-keep >= len(s.marker) {
+				keep = len(s.pending)
+			}
+			s.appendOutput(s.pending[:keep])
+			s.pending = append(s.pending[:0], s.pending[keep:]...)
+			return
+		}
+		end := bytes.IndexByte(s.pending[i:], '\n')
+		if end < 0 {
+			s.appendOutput(s.pending[:i])
+			s.pending = append(s.pending[:0], s.pending[i:]...)
+			return
+		}
+		s.appendOutput(s.pending[:i])
+		var status pySessionCellStatus
+		_ = json.Unmarshal(s.pending[i+len(s.marker):i+end], &status)
+		select {
+		case s.status <- status:
+		default:
+		}
+		s.pending = append(s.pending[:0], s.pending[i+end+1:]...)
+	}
+}
+
+// appendOutput stores up to pyLimits.MaxOutput bytes of cell output. Must hold s.mu
+func (s *pySession) appendOutput(b []byte) {
+	if room := pyLimits.MaxOutput - s.out.Len(); len(b) > room {
+		b = b[:room]
+		s.truncated = true
+	}
+	s.out.Write(b)
+}
+
+// send writes a message to the driver
+func (s *pySession) send(msg map[string]string) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err = s.stdin.Write(append(b, '\n')); err != nil {
+		return errPySessionClosed
+	}
+	return nil
+}
+
+// interrupt raises KeyboardInterrupt in the running cell, if any
+func (s *pySession) interrupt() error {
+	return s.send(map[string]string{"op": "interrupt"})
+}
+
+// runCell runs a cell and returns its output. Cells running for longer
+// than PY_SESSION_CELL_TIMEOUT are interrupted and if they don't stop
+// the session is killed.
+func (s *pySession) runCell(source, stdin string) (output string, status pySessionCellStatus, elapsed time.Duration, err error) {
+	s.mu.Lock()
+	if s.busy {
+		s.mu.Unlock()
+		return "", status, 0, errPySessionBusy
+	}
+	s.busy, s.truncated = true, false
+	s.out.Reset()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.busy = false
+		s.mu.Unlock()
+	}()
+	s.idle.Reset(pySessionIdleTimeout)
+
+	tstart := time.Now()
+	if err = s.send(map[string]string{"op": "cell", "code": source, "stdin": stdin}); err != nil {
+		return "", status, 0, s.exitError()
+	}
+	timer := time.NewTimer(pySessionCellTimeout)
+	defer timer.Stop()
+	select {
+	case status = <-s.status:
+	case <-s.done:
+		err = s.exitErr
+	case <-timer.C:
+		_ = s.interrupt()
+		select {
+		case status = <-s.status:
+		case <-s.done:
+			err = s.exitErr
+		case <-time.After(pySessionInterruptGrace):
+			s.close()
+			err = fmt.Errorf("cell did not stop after %s and session was restarted", pySessionCellTimeout)
+		}
+	}
+	elapsed = time.Since(tstart)
+	s.mu.Lock()
+	output = s.out.String()
+	if s.truncated {
+		output += fmt.Sprintf("\noutput truncated to %d bytes", pyLimits.MaxOutput)
+	}
+	s.mu.Unlock()
+	return output, status, elapsed, err
+}
+
+// exitError returns why session ended once it has
+func (s *pySession) exitError() error {
+	select {
+	case <-s.done:
+		return s.exitErr
+	case <-time.After(pySessionInterruptGrace):
+		return errPySessionClosed
+	}
+}
+
+// PySessionCellPost runs a cell in the user's session, starting it if needed
+func PySessionCellPost(c buffalo.Context) error {
+	p := pythonHandler{}
+	user, ok := c.Value("current_user").(*models.User)
+	if !ok || user == nil {
+		return c.Render(403, r.HTML("index.plush.html"))
+	}
+	p.UserName = user.Name
+	p.userID = Encode([]rune(user.ID.String()), Abc64safe)
+	if err := c.Bind(&p.code); err != nil {
+		return c.Error(400, err)
+	}
+	if p.code.Evaluation != uuid.Nil {
+		return p.codeResult(c, "", T.Translate(c, "curso-python-session-evaluation"))
+	}
+	if err := p.code.sanitizePy(&defaultPyPolicy); err != nil {
+		return p.codeResult(c, "", err.Error())
+	}
+	s := getPySession(user.ID)
+	if s == nil {
+		datasets, err := runDatasets(c.Value("tx").(*pop.Connection), uuid.Nil)
+		if err != nil {
+			return c.Error(500, err)
+		}
+		p.datasets = datasets
+		if s, err = startPySession(user.ID, &p); err != nil {
+			return c.Error(500, err)
+		}
+		if s == nil {
+			return p.codeResult(c, "", T.Translate(c, "curso-python-session-full"))
+		}
+	}
+	output, status, elapsed, err := s.runCell(p.Source, p.Input)
+	if err == errPySessionBusy {
+		return p.codeResult(c, "", T.Translate(c, "curso-python-session-busy"))
+	}
+	p.Elapsed = append(p.Elapsed, elapsed)
+	defer p.PutTx(c.Value("kv").(models.KV), c)
+	switch {
+	case err != nil:
+		return p.codeResult(c, output, err.Error()+"\n"+T.Translate(c, "curso-python-session-restarted"))
+	case !status.OK:
+		p.Exception = parseTraceback(output, fmt.Sprintf("<celda %d>", status.Cell), p.Source)
+		return p.codeResult(c, "", output)
+	}
+	return p.codeResult(c, output)
+}
+
+// PySessionInterruptPost interrupts the running cell of the user's session
+func PySessionInterruptPost(c buffalo.Context) error {
+	user, ok := c.Value("current_user").(*models.User)
+	if !ok || user == nil {
+		return c.Error(403, fmt.Errorf("user not logged in"))
+	}
+	if s := getPySession(user.ID); s != nil {
+		_ = s.interrupt()
+	}
+	return c.Render(200, r.JSON(map[string]bool{"ok": true}))
+}
+
+// PySessionRestartPost kills the user's session. The next cell starts a new one
+func PySessionRestartPost(c buffalo.Context) error {
+	user, ok := c.Value("current_user").(*models.User)
+	if !ok || user == nil {
+		return c.Error(403, fmt.Errorf("user not logged in"))
+	}
+	if s := getPySession(user.ID); s != nil {
+		s.close()
+	}
+	return c.Render(200, r.JSON(map[string]bool{"ok": true}))
+}
@@ -0,0 +1,257 @@
+package actions
+
+// Interactive python runs. The browser starts a run with a POST which
+// returns a stream ID and then opens an EventSource (server-sent events)
+// on the stream to receive output as it is produced. Lines typed by
+// the user are POSTed to the stream and written to the program's stdin.
+// Interactive runs go through the same sanitization, limits and worker
+// pool as regular runs except for wall time, which is PY_STREAM_TIMEOUT
+// since programs spend most of their time waiting for the user to type.
+// Since they hold a worker while waiting, there may only be PY_STREAMS
+// streams at a time, pyMaxStreamsPerUser of them per user. Stream events
+// are served without a database transaction for the same reason.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/buffalo/render"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+)
+
+const (
+	// streams not connected to within this time are discarded
+	pyStreamConnectTimeout = time.Minute
+	pyMaxStdinLineLength   = 4096
+	pyMaxStreamsPerUser    = 2
+)
+
+// Set in init()
+var (
+	pyStreamTimeout time.Duration
+	// pyMaxStreams is the amount of streams, connected or not, there may be at a time
+	pyMaxStreams int
+)
+
+func init() {
+	var err error
+	pyStreamTimeout, err = time.ParseDuration(envy.Get("PY_STREAM_TIMEOUT", "60s"))
+	must(err)
+	// half the workers are left for regular runs by default. pyWorkers is set in pypool.go's init
+	pyMaxStreams, err = strconv.Atoi(envy.Get("PY_STREAMS", strconv.Itoa((pyWorkers.Stats().Workers+1)/2)))
+	must(err)
+}
+
+// pyStream is an interactive run. It runs once the browser connects to its events.
+type pyStream struct {
+	p      pythonHandler
+	userID uuid.UUID
+	// stdin is nil until the run starts
+	stdin *io.PipeWriter
+}
+
+var pyStreams = struct {
+	sync.Mutex
+	m map[string]*pyStream
+}{m: make(map[string]*pyStream)}
+
+// getPyStream returns user's stream with id or nil if there is no such stream
+func getPyStream(id string, userID uuid.UUID) *pyStream {
+	pyStreams.Lock()
+	defer pyStreams.Unlock()
+	s := pyStreams.m[id]
+	if s == nil || s.userID != userID {
+		return nil
+	}
+	return s
+}
+
+// InterpretStreamPost creates an interactive run of the submitted
+// code and responds with its ID. Code is checked before responding
+// so sanitization errors are reported like in InterpretPost.
+func InterpretStreamPost(c buffalo.Context) error {
+	p := pythonHandler{}
+	user, ok := c.Value("current_user").(*models.User)
+	if !ok || user == nil {
+		return c.Render(403, r.HTML("index.plush.html"))
+	}
+	p.UserName = user.Name
+	p.userID = Encode([]rune(user.ID.String()), Abc64safe)
+	if err := c.Bind(&p.code); err != nil {
+		return c.Error(400, err)
+	}
+	if p.code.Evaluation != uuid.Nil {
+		return p.codeResult(c, "", T.Translate(c, "curso-python-interpreter-stream-evaluation"))
+	}
+	if err := p.code.sanitizePy(&defaultPyPolicy); err != nil {
+		return p.codeResult(c, "", err.Error())
+	}
+	datasets, err := runDatasets(c.Value("tx").(*pop.Connection), uuid.Nil)
+	if err != nil {
+		return c.Error(500, err)
+	}
+	p.datasets = datasets
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return c.Error(500, err)
+	}
+	id := hex.EncodeToString(b)
+	s := &pyStream{p: p, userID: user.ID}
+	pyStreams.Lock()
+	userStreams := 0
+	for _, other := range pyStreams.m {
+		if other.userID == user.ID {
+			userStreams++
+		}
+	}
+	if userStreams >= pyMaxStreamsPerUser || len(pyStreams.m) >= pyMaxStreams {
+		pyStreams.Unlock()
+		return p.codeResult(c, "", T.Translate(c, "curso-python-interpreter-stream-limit"))
+	}
+	pyStreams.m[id] = s
+	pyStreams.Unlock()
+	time.AfterFunc(pyStreamConnectTimeout, func() {
+		pyStreams.Lock()
+		defer pyStreams.Unlock()
+		if pyStreams.m[id] == s && s.stdin == nil {
+			delete(pyStreams.m, id)
+		}
+	})
+	return c.Render(200, r.JSON(map[string]string{"id": id}))
+}
+
+// pyStreamStatus is the last event of a stream
+type pyStreamStatus struct {
+	Error     string        `json:"error"`
+	Elapsed   time.Duration `json:"elapsed"`
+	Limit     string        `json:"limit,omitempty"`
+	Figures   []pyFigure    `json:"figures,omitempty"`
+	Warnings  []pyWarning   `json:"warnings,omitempty"`
+	Exception *pyException  `json:"exception,omitempty"`
+}
+
+// InterpretStreamGet runs an interactive run and sends its output as
+// server-sent events. "stdout" and "stderr" events carry output chunks
+// as JSON strings and a final "status" event carries a pyStreamStatus.
+// Run stdin is closed if the browser disconnects. It is served without
+// a transaction so the run is stored in its own once it ends.
+func InterpretStreamGet(c buffalo.Context) error {
+	user, ok := c.Value("current_user").(*models.User)
+	if !ok || user == nil {
+		return c.Error(403, fmt.Errorf("user not logged in"))
+	}
+	id := c.Param("sid")
+	s := getPyStream(id, user.ID)
+	pr, pw := io.Pipe()
+	pyStreams.Lock()
+	if s == nil || s.stdin != nil {
+		pyStreams.Unlock()
+		return c.Error(404, fmt.Errorf("python stream %s not found", id))
+	}
+	s.stdin = pw
+	pyStreams.Unlock()
+	defer func() {
+		pyStreams.Lock()
+		delete(pyStreams.m, id)
+		pyStreams.Unlock()
+	}()
+
+	w := c.Response()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return c.Error(500, fmt.Errorf("streaming not supported by response writer"))
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx buffers responses by default
+	w.WriteHeader(200)
+	flusher.Flush()
+	var mu sync.Mutex // stdout and stderr are written concurrently
+	send := func(event string, v interface{}) {
+		data, _ := json.Marshal(v)
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+
+	p := &s.p
+	limits := pyLimits
+	limits.Timeout = pyStreamTimeout
+	p.limits, p.stdin = &limits, pr
+	p.stream = func(stream string, chunk []byte) {
+		send(stream, string(chunk))
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.Request().Context().Done():
+			// python gets EOFError on input()
+			pw.Close()
+		case <-done:
+		}
+	}()
+	err := p.run(pyRunner)
+	pw.Close()
+	if busy, ok := err.(*pyBusyError); ok {
+		send("status", pyStreamStatus{Error: T.Translate(c, "curso-python-interpreter-busy", render.Data{"seconds": busy.seconds()})})
+		return nil
+	}
+	_ = models.KVUpdate(func(kv models.KV) error {
+		p.PutTx(kv, c)
+		return nil
+	})
+	p.Exception.explain(c)
+	status := pyStreamStatus{Limit: p.Limit, Figures: p.Figures, Warnings: p.Warnings, Exception: p.Exception}
+	if len(p.Elapsed) > 0 {
+		status.Elapsed = p.Elapsed[0]
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	send("status", status)
+	return nil
+}
+
+// InterpretStreamStdinPost writes a line to the stdin of a running interactive run
+func InterpretStreamStdinPost(c buffalo.Context) error {
+	user, ok := c.Value("current_user").(*models.User)
+	if !ok || user == nil {
+		return c.Error(403, fmt.Errorf("user not logged in"))
+	}
+	var form struct {
+		Line string `form:"line"`
+	}
+	if err := c.Bind(&form); err != nil {
+		return c.Error(400, err)
+	}
+	if len(form.Line) > pyMaxStdinLineLength {
+		return c.Error(413, fmt.Errorf("stdin line longer than %d bytes", pyMaxStdinLineLength))
+	}
+	s := getPyStream(c.Param("sid"), user.ID)
+	pyStreams.Lock()
+	var stdin *io.PipeWriter
+	if s != nil {
+		stdin = s.stdin
+	}
+	pyStreams.Unlock()
+	if stdin == nil {
+		return c.Error(404, fmt.Errorf("python stream %s not running", c.Param("sid")))
+	}
+	if _, err := io.WriteString(stdin, form.Line+"\n"); err != nil {
+		return c.Error(410, err)
+	}
+	return c.Render(200, r.JSON(map[string]bool{"ok": true}))
+}
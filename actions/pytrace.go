@@ -0,0 +1,246 @@
+package actions
+
+// Step by step traces of student programs, as in Python Tutor. The
+// program is sanitized like any other and then run inside
+// pyTraceHarness which records every executed line of the program
+// with the call stack and local variables. The browser steps
+// forward and back through the trace.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gofrs/uuid"
+)
+
+// Set in init()
+var (
+	pyTraceMaxSteps int
+	pyTraceLimits   RunLimits
+)
+
+func init() {
+	var err error
+	pyTraceMaxSteps, err = strconv.Atoi(envy.Get("PY_TRACE_MAX_STEPS", "500"))
+	must(err)
+	pyTraceLimits = pyLimits
+	// traces are much longer than program output
+	pyTraceLimits.MaxOutput, err = strconv.Atoi(envy.Get("PY_TRACE_MAX_OUTPUT", "1048576"))
+	must(err)
+	pyTraceLimits.MaxFigures = 0
+}
+
+// pyTraceHarness runs {code} tracing it with sys.settrace. Program
+// output is captured and the trace is printed as JSON on the last line.
+const pyTraceHarness = `# Tracing harness. Runs the program recording every executed line.
+import io
+import json
+import sys
+import traceback
+
+_code = {code}
+_filename = "<programa>"
+_max_steps = {max_steps}
+_max_output = {max_output}
+_max_vars = 20
+_max_frames = 10
+_steps = []
+_out = io.StringIO()
+
+
+class _StepLimit(BaseException):
+    pass
+
+
+def _value(v):
+    if type(v).__name__ in ("function", "type", "builtin_function_or_method"):
+        return "<%s %s>" % (type(v).__name__, getattr(v, "__name__", "?"))
+    try:
+        r = repr(v)
+    except Exception:
+        r = "<?>"
+    return r if len(r) <= 80 else r[:77] + "..."
+
+
+def _locals(frame):
+    out = {}
+    for k, v in frame.f_locals.items():
+        if k.startswith("__") or type(v).__name__ == "module":
+            continue
+        if len(out) == _max_vars:
+            break
+        out[k] = _value(v)
+    return out
+
+
+def _stack(frame):
+    frames = []
+    while frame is not None and len(frames) < _max_frames:
+        if frame.f_code.co_filename == _filename:
+            frames.append({"func": frame.f_code.co_name, "line": frame.f_lineno, "locals": _locals(frame)})
+        frame = frame.f_back
+    frames.reverse()
+    return frames
+
+
+def _trace(frame, event, arg):
+    if frame.f_code.co_filename != _filename:
+        return None
+    if event in ("line", "return", "exception"):
+        if len(_steps) >= _max_steps:
+            raise _StepLimit
+        step = {"event": event, "line": frame.f_lineno, "stack": _stack(frame), "out": _out.tell()}
+        if event == "return":
+            step["return"] = _value(arg)
+        elif event == "exception":
+            step["exception"] = arg[0].__name__
+        _steps.append(step)
+    return _trace
+
+
+def _format(e):
+    frames = [f for f in traceback.extract_tb(e.__traceback__) if f.filename == _filename]
+    s = ""
+    if frames:
+        s = "Traceback (most recent call last):\n" + "".join(traceback.format_list(frames))
+    return s + "".join(traceback.format_exception_only(type(e), e))
+
+
+def _main():
+    real = sys.stdout
+    sys.stdout = sys.stderr = _out
+    error = ""
+    try:
+        code = compile(_code, _filename, "exec")
+        sys.settrace(_trace)
+        try:
+            exec(code, {"__name__": "__main__", "__builtins__": __builtins__})
+        finally:
+            sys.settrace(None)
+    except _StepLimit:
+        pass
+    except SystemExit as e:
+        if e.code not in (None, 0):
+            error = _format(e)
+    except BaseException as e:
+        error = _format(e)
+    sys.stdout, sys.stderr = real, sys.__stderr__
+    trace = {"steps": _steps, "output": _out.getvalue()[:_max_output], "error": error,
+             "truncated": len(_steps) >= _max_steps}
+    real.write("\n" + json.dumps(trace) + "\n")
+
+
+_main()
+`
+
+// pyTrace is the execution trace of a program
+type pyTrace struct {
+	Steps []pyTraceStep `json:"steps"`
+	// Output is everything the program printed. Steps refer to it by length
+	Output string `json:"output"`
+	Error  string `json:"error"`
+	// Truncated is true if the program ran more than PY_TRACE_MAX_STEPS steps
+	Truncated bool `json:"truncated"`
+}
+
+// pyTraceStep is the state of the program when a line runs or a function returns or raises
+type pyTraceStep struct {
+	// Event is "line", "return" or "exception"
+	Event string         `json:"event"`
+	Line  int            `json:"line"`
+	Stack []pyTraceFrame `json:"stack"`
+	// Out is the length of output printed before the step
+	Out       int    `json:"out"`
+	Return    string `json:"return,omitempty"`
+	Exception string `json:"exception,omitempty"`
+}
+
+// pyTraceFrame is a function call of the program. Locals are repr() of values
+type pyTraceFrame struct {
+	Func   string            `json:"func"`
+	Line   int               `json:"line"`
+	Locals map[string]string `json:"locals"`
+}
+
+// traceHarness returns the harness which traces source.
+func traceHarness(source string) string {
+	// a JSON string is a valid python string literal
+	code, _ := json.Marshal(source)
+	return strings.NewReplacer("{code}", string(code), "{max_steps}", strconv.Itoa(pyTraceMaxSteps),
+		"{max_output}", strconv.Itoa(pyLimits.MaxOutput)).Replace(pyTraceHarness)
+}
+
+// parseTrace reads the trace printed on the last line of a harness' output
+func parseTrace(output string) (trace pyTrace, err error) {
+	output = strings.TrimRight(output, "\n")
+	if i := strings.LastIndexByte(output, '\n'); i >= 0 {
+		output = output[i+1:]
+	}
+	if err = json.Unmarshal([]byte(output), &trace); err != nil {
+		return trace, fmt.Errorf("reading trace: %s", err)
+	}
+	return trace, nil
+}
+
+// InterpretTracePost runs submitted code under the tracing harness and
+// responds with the trace next to the usual output and error.
+func InterpretTracePost(c buffalo.Context) error {
+	p := pythonHandler{}
+	user, ok := c.Value("current_user").(*models.User)
+	if !ok || user == nil {
+		return c.Render(403, r.HTML("index.plush.html"))
+	}
+	p.UserName = user.Name
+	p.userID = Encode([]rune(user.ID.String()), Abc64safe)
+	if err := c.Bind(&p.code); err != nil {
+		return c.Error(400, err)
+	}
+	if p.code.Evaluation != uuid.Nil {
+		return p.codeResult(c, "", T.Translate(c, "curso-python-trace-evaluation"))
+	}
+	// the harness is trusted code and is not sanitized, the program is
+	if err := p.code.sanitizePy(&defaultPyPolicy); err != nil {
+		return p.codeResult(c, "", err.Error())
+	}
+	datasets, err := runDatasets(c.Value("tx").(*pop.Connection), uuid.Nil)
+	if err != nil {
+		return c.Error(500, err)
+	}
+	res, err := pyWorkers.Run(pyRunner, &RunJob{
+		Source:   traceHarness(p.Source),
+		Input:    p.Input,
+		UserName: p.UserName,
+		UserID:   p.userID,
+		Limits:   pyTraceLimits,
+		Datasets: datasets,
+	})
+	if busy, ok := err.(*pyBusyError); ok {
+		return p.busyResult(c, busy)
+	}
+	if err != nil {
+		return c.Error(500, err)
+	}
+	p.Elapsed = append(p.Elapsed, res.Elapsed)
+	p.Limit = res.Limit
+	defer p.PutTx(c.Value("kv").(models.KV), c)
+	if err = limitError(res, &pyTraceLimits); err != nil {
+		return p.codeResult(c, "", err.Error())
+	}
+	trace, err := parseTrace(res.Output)
+	if err != nil {
+		return p.codeResult(c, "", res.Output)
+	}
+	p.Output, p.Error = trace.Output, trace.Error
+	p.Exception = parseTraceback(trace.Error, "<programa>", p.Source)
+	p.Exception.explain(c)
+	return c.Render(200, r.JSON(struct {
+		result
+		Trace pyTrace `json:"trace"`
+	}{p.result, trace}))
+}
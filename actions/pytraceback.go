@@ -0,0 +1,78 @@
+package actions
+
+// Tracebacks of failed runs are parsed so the editor can mark the
+// failing line and beginners get an explanation of common exceptions
+// in their own language.
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gobuffalo/buffalo"
+)
+
+// pyException is the exception which ended a python run
+type pyException struct {
+	// Type is the exception class, i.e. ZeroDivisionError
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	// Line is the line of user code where the exception was raised. 0 if unknown
+	Line int `json:"line,omitempty"`
+	// Snippet is the source code of Line
+	Snippet string `json:"snippet,omitempty"`
+	// Hint explains the exception to beginners in the user's locale
+	Hint string `json:"hint,omitempty"`
+}
+
+var (
+	pyFrameRx     = regexp.MustCompile(`^\s*File\s+(?:"(.*)",\s*)?line (\d+)`)
+	pyExceptionRx = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?::\s?(.*))?$`)
+)
+
+// pyHintExceptions have an explanation in locales with id curso-python-hint-<type>
+var pyHintExceptions = setOf("AttributeError", "EOFError", "FileNotFoundError", "IndentationError", "IndexError",
+	"KeyError", "ModuleNotFoundError", "NameError", "RecursionError", "SyntaxError", "TabError", "TypeError",
+	"UnboundLocalError", "ValueError", "ZeroDivisionError")
+
+// parseTraceback returns the exception of the traceback python printed
+// in output or nil if there is none. Frames of file filename are user
+// code from source. Runners strip the filename of user code so it is
+// empty for runs.
+func parseTraceback(output, filename, source string) *pyException {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	last, line := -1, 0
+	for i, l := range lines {
+		m := pyFrameRx.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		last = i
+		if m[1] == filename {
+			line, _ = strconv.Atoi(m[2])
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	// frames are followed by indented source and carets, then the exception
+	for _, l := range lines[last+1:] {
+		m := pyExceptionRx.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		exc := &pyException{Type: m[1], Message: m[2], Line: line}
+		if src := strings.Split(source, "\n"); line > 0 && line <= len(src) {
+			exc.Snippet = strings.TrimSpace(src[line-1])
+		}
+		return exc
+	}
+	return nil
+}
+
+// explain sets the hint of common exceptions. exc may be nil
+func (exc *pyException) explain(c buffalo.Context) {
+	if exc != nil && pyHintExceptions[exc.Type] {
+		exc.Hint = T.Translate(c, "curso-python-hint-"+exc.Type)
+	}
+}
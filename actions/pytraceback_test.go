@@ -0,0 +1,56 @@
+package actions
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceback(t *testing.T) {
+	const source = "def f(n):\n    return f(n + 1)\n\nprint(1 / 0)\n"
+	recursion := []string{"Traceback (most recent call last):", "  File line 4, in <module>"}
+	for i := 0; i < 3; i++ {
+		recursion = append(recursion, "  File line 2, in f", "    return f(n + 1)")
+	}
+	recursion = append(recursion, "  [Previous line repeated 996 more times]",
+		"RecursionError: maximum recursion depth exceeded")
+	for _, test := range []struct {
+		name, output, filename string
+		want                   *pyException
+	}{
+		{name: "no traceback", output: "hola\nValueError: printed by the program\n"},
+		{name: "exception", output: "1\nTraceback (most recent call last):\n  File line 4, in <module>\n" +
+			"ZeroDivisionError: division by zero\n",
+			want: &pyException{Type: "ZeroDivisionError", Message: "division by zero", Line: 4, Snippet: "print(1 / 0)"}},
+		{name: "carets", output: "Traceback (most recent call last):\n  File line 4, in <module>\n    print(1 / 0)\n" +
+			"          ~~^~~\nZeroDivisionError: division by zero\n",
+			want: &pyException{Type: "ZeroDivisionError", Message: "division by zero", Line: 4, Snippet: "print(1 / 0)"}},
+		{name: "library frame", output: "Traceback (most recent call last):\n  File line 2, in f\n" +
+			"  File \"/usr/lib/python3/dist-packages/numpy/core/fromnumeric.py\", line 86, in _wrapreduction\n" +
+			"    return ufunc.reduce(obj, axis, dtype, out, **passkwargs)\nnumpy.core._exceptions.UFuncTypeError: bad types\n",
+			want: &pyException{Type: "numpy.core._exceptions.UFuncTypeError", Message: "bad types", Line: 2, Snippet: "return f(n + 1)"}},
+		{name: "recursion", output: strings.Join(recursion, "\n"),
+			want: &pyException{Type: "RecursionError", Message: "maximum recursion depth exceeded", Line: 2, Snippet: "return f(n + 1)"}},
+		{name: "chained", output: "Traceback (most recent call last):\n  File line 4, in <module>\nKeyError: 'a'\n\n" +
+			"During handling of the above exception, another exception occurred:\n\n" +
+			"Traceback (most recent call last):\n  File line 1, in <module>\nValueError: b\n",
+			want: &pyException{Type: "ValueError", Message: "b", Line: 1, Snippet: "def f(n):"}},
+		{name: "syntax error", output: "  File line 2\n    return f(n + 1\n                  ^\nSyntaxError: '(' was never closed\n",
+			want: &pyException{Type: "SyntaxError", Message: "'(' was never closed", Line: 2, Snippet: "return f(n + 1)"}},
+		{name: "no message", output: "Traceback (most recent call last):\n  File line 4, in <module>\nKeyboardInterrupt\n",
+			want: &pyException{Type: "KeyboardInterrupt", Line: 4, Snippet: "print(1 / 0)"}},
+		{name: "line out of source", output: "Traceback (most recent call last):\n  File line 40, in <module>\nNameError: x\n",
+			want: &pyException{Type: "NameError", Message: "x", Line: 40}},
+		{name: "no user frame", output: "Traceback (most recent call last):\n  File \"<frozen runpy>\", line 1, in <module>\nSystemError: x\n",
+			want: &pyException{Type: "SystemError", Message: "x"}},
+		{name: "truncated frames", output: "Traceback (most recent call last):\n  File line 4, in <module>\n    print(1"},
+		{name: "truncated before frames", output: "Traceback (most recent call last):\n"},
+		{name: "named file", filename: "<celda 2>", output: "Traceback (most recent call last):\n" +
+			"  File \"<celda 2>\", line 4, in <module>\n  File \"<celda 1>\", line 1, in f\nTypeError: x\n",
+			want: &pyException{Type: "TypeError", Message: "x", Line: 4, Snippet: "print(1 / 0)"}},
+	} {
+		if got := parseTraceback(test.output, test.filename, source); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
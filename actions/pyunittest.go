@@ -0,0 +1,137 @@
+package actions
+
+// Unit test evaluations grade submissions by the functions they define
+// instead of by their output. The evaluation's harness runs with the
+// submission in its working directory as module alumno (see
+// models.EvaluationUnitTestModule), imports it, calls its functions
+// and reports results with reportar(), defined by pyUnitTestPrelude:
+//
+//	import alumno
+//	tests = []
+//	for n, want in [(7, True), (9, False)]:
+//	    try:
+//	        got = alumno.es_primo(n)
+//	        passed = type(got) is type(want) and want == got
+//	        tests.append({"name": "es_primo(%d)" % n, "passed": passed,
+//	                      "message": "devolvió %r, se esperaba %r" % (got, want)})
+//	    except Exception as e:
+//	        tests.append({"name": "es_primo(%d)" % n, "passed": False, "message": repr(e)})
+//	reportar(tests)
+//
+// Results are printed after a random marker the prelude reads from stdin
+// before the submission is imported so submissions can't report results.
+// Harnesses must check the type of returned values before comparing them
+// since submissions may return objects which define __eq__ to always be equal.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+)
+
+// pyUnitTestPrelude is prepended to unit test harnesses
+const pyUnitTestPrelude = `# Unit test prelude. Reads the results marker before the submission is imported
+import json as _json
+import sys as _sys
+
+_marker = _sys.stdin.readline().rstrip("\n")
+_write, _dumps = _sys.__stdout__.write, _json.dumps
+
+
+def reportar(tests):
+    """Reports results of tests, a list of dicts with keys name, passed and
+    optionally message, weight (1 by default) and hidden."""
+    _sys.stdout.flush()
+    _write("\n" + _marker + _dumps(tests) + "\n")
+
+
+`
+
+// pyUnitTest is the result of a test of a unit test harness
+type pyUnitTest struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Message explains why the test failed
+	Message string `json:"message"`
+	// Weight defaults to 1
+	Weight *float64 `json:"weight"`
+	Hidden bool     `json:"hidden"`
+}
+
+// pyHarnessError is returned when a unit test harness ran
+// but did not report valid results. It is not the user's fault.
+type pyHarnessError struct {
+	err error
+}
+
+func (e *pyHarnessError) Error() string {
+	return "unit test harness: " + e.err.Error()
+}
+
+// runUnitTests runs eval's harness on the user's code with runner.
+// Output printed by the user's code and the harness is left in p.Output.
+// The code is not checked, callers check untrusted code with p.check first.
+func (p *pythonHandler) runUnitTests(runner Runner, eval *models.Evaluation) ([]pyUnitTest, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	marker := "\x1e" + hex.EncodeToString(b) + ":"
+	module := models.EvaluationUnitTestModule + ".py"
+	files := map[string][]byte{module: []byte(p.Source)}
+	defer func(input string) { p.Input = input }(p.Input)
+	p.Input = marker
+	if err := p.runSource(runner, pyUnitTestPrelude+eval.Harness.String, files, module); err != nil {
+		return nil, err
+	}
+	output, tests, err := parseUnitTests(p.Output, marker)
+	if err != nil {
+		return nil, &pyHarnessError{err}
+	}
+	p.Output = output
+	return tests, nil
+}
+
+// parseUnitTests splits output of a harness into what was printed and
+// the results reported after marker. Missing names and weights are filled in.
+func parseUnitTests(output, marker string) (printed string, tests []pyUnitTest, err error) {
+	i := strings.LastIndex(output, marker)
+	if i < 0 {
+		return "", nil, errors.New("results not reported, call reportar(tests)")
+	}
+	line := output[i+len(marker):]
+	if j := strings.IndexByte(line, '\n'); j >= 0 {
+		line = line[:j]
+	}
+	if err = json.Unmarshal([]byte(line), &tests); err != nil {
+		return "", nil, fmt.Errorf("reading results: %s", err)
+	}
+	if len(tests) == 0 {
+		return "", nil, errors.New("no tests reported")
+	}
+	var total float64
+	for k := range tests {
+		if tests[k].Name == "" {
+			tests[k].Name = strconv.Itoa(k + 1)
+		}
+		if tests[k].Weight == nil {
+			one := 1.
+			tests[k].Weight = &one
+		}
+		if *tests[k].Weight < 0 {
+			return "", nil, fmt.Errorf("test %s has negative weight", tests[k].Name)
+		}
+		total += *tests[k].Weight
+	}
+	if total == 0 {
+		return "", nil, errors.New("test weights add up to 0")
+	}
+	// reportar writes a newline before the results
+	return strings.TrimSuffix(output[:i], "\n"), tests, nil
+}
@@ -0,0 +1,58 @@
+package actions
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseUnitTests(t *testing.T) {
+	const marker = "\x1e0123456789abcdef0123456789abcdef:"
+	const spoof = "\x1effffffffffffffffffffffffffffffff:"
+	for _, test := range []struct {
+		name, output string
+		printed      string
+		// tests are the reported tests as name:passed:weight
+		tests []string
+		// err is a substring of the error, empty if results are valid
+		err string
+	}{
+		{name: "results", output: "hola\n\n" + marker + `[{"name":"a","passed":true},{"passed":false,"message":"m","weight":2}]` + "\n",
+			printed: "hola\n", tests: []string{"a:true:1", "2:false:2"}},
+		{name: "nothing printed", output: "\n" + marker + `[{"name":"a","passed":true}]` + "\n", tests: []string{"a:true:1"}},
+		{name: "spoofed marker", output: "\n" + spoof + `[{"name":"a","passed":true}]` + "\n", err: "results not reported"},
+		{name: "spoofed marker before results", output: spoof + `[{"name":"a","passed":true}]` + "\n\n" + marker + `[{"name":"a","passed":false}]` + "\n",
+			printed: spoof + `[{"name":"a","passed":true}]` + "\n", tests: []string{"a:false:1"}},
+		{name: "marker without separator", output: strings.TrimSuffix(marker, ":") + `[{"name":"a","passed":true}]` + "\n", err: "results not reported"},
+		{name: "printed after results", output: "\n" + marker + `[{"name":"a","passed":true}]` + "\nfin\n", tests: []string{"a:true:1"}},
+		{name: "reported twice", output: "\n" + marker + `[{"name":"a","passed":true}]` + "\n\n" + marker + `[{"name":"b","passed":true}]` + "\n",
+			printed: "\n" + marker + `[{"name":"a","passed":true}]` + "\n", tests: []string{"b:true:1"}},
+		{name: "not reported", output: "hola\n", err: "results not reported"},
+		{name: "truncated results", output: "\n" + marker + `[{"name":"a","pass`, err: "reading results"},
+		{name: "no tests", output: "\n" + marker + "[]\n", err: "no tests reported"},
+		{name: "negative weight", output: "\n" + marker + `[{"name":"a","passed":true,"weight":-1}]` + "\n", err: "negative weight"},
+		{name: "zero weights", output: "\n" + marker + `[{"name":"a","passed":true,"weight":0}]` + "\n", err: "add up to 0"},
+	} {
+		printed, tests, err := parseUnitTests(test.output, marker)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if printed != test.printed {
+			t.Errorf("%s: got printed %q, want %q", test.name, printed, test.printed)
+		}
+		var got []string
+		for _, tc := range tests {
+			got = append(got, fmt.Sprintf("%s:%t:%g", tc.Name, tc.Passed, *tc.Weight))
+		}
+		if strings.Join(got, " ") != strings.Join(test.tests, " ") {
+			t.Errorf("%s: got tests %q, want %q", test.name, got, test.tests)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
 	"github.com/gobuffalo/buffalo/render"
 	"github.com/gobuffalo/helpers"
+	"github.com/gobuffalo/nulls"
 	"github.com/gobuffalo/packr/v2"
 	"github.com/gobuffalo/plush/v4"
 )
@@ -49,6 +50,8 @@ func init() {
 			"bicon":       bootstrapIcon,
 			"userIcon":    userIcon,
 			"timeSince":   timeSince,
+			"windowTime":  func(t nulls.Time) string { return windowTime(t, evaluationTimeLayout) },
+			"windowInput": func(t nulls.Time) string { return windowTime(t, evaluationWindowLayout) },
 			"joinPath":    joinPath,
 			"displayName": DisplayName,
 			"encoders":    helpers.Encoders,
@@ -99,6 +102,15 @@ func DisplayName(u interface{}) string {
 
 func derefUser(u models.User) *models.User { return &u }
 
+// windowTime formats times of evaluation availability windows
+// in server time. Unset times are empty.
+func windowTime(t nulls.Time, layout string) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.Local().Format(layout)
+}
+
 func timeSince(created time.Time, ctx plush.HelperContext) string {
 	if true && false {
 		return created.UTC().Format(time.RFC3339)
@@ -3,7 +3,6 @@ package actions
 import (
 	"encoding/csv"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -13,14 +12,9 @@ import (
 	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
 	"github.com/gobuffalo/buffalo"
 	"github.com/gobuffalo/pop/v5"
-	"go.etcd.io/bbolt"
 )
 
-var (
-	errBucketNotFound = errors.New("did not find " + safeUsersBucketName + " bucket in bolt database")
-)
-
-// name must be first created in models/bbolt.go in init()
+// name must be in models.KVBuckets
 const safeUsersBucketName = "safeUsers"
 
 type safeUser struct {
@@ -41,6 +35,8 @@ func (s safeUsers) String() (out string) {
 var (
 	words   []string
 	teamIDs map[string]int
+	// registeredTeamIDs are the team IDs in teamIDs
+	registeredTeamIDs map[string]bool
 )
 
 func init() {
@@ -58,6 +54,7 @@ func init() {
 	records, err := r.ReadAll()
 	must(err)
 	teamIDs = make(map[string]int)
+	registeredTeamIDs = make(map[string]bool)
 	for _, r := range records[1:] { // exclude header
 		if len(r) != 2 {
 			must(fmt.Errorf("error reading teamid records %q", r))
@@ -68,29 +65,23 @@ func init() {
 			must(fmt.Errorf("mail %q is not valid", r[1]))
 		}
 		teamIDs[r[1]] = id
+		registeredTeamIDs[strconv.Itoa(id)] = true
 	}
 }
 
 // SafeListGet renders page with safelist. only admins can see
 func SafeListGet(c buffalo.Context) error {
 	var users safeUsers
-	btx := c.Value("btx").(*bbolt.Tx)
-	err := func() error {
-		b := btx.Bucket([]byte(safeUsersBucketName))
-		if b == nil {
-			return errBucketNotFound
+	kv := c.Value("kv").(models.KV)
+	err := kv.ForEach(safeUsersBucketName, nil, func(_, v []byte) error {
+		var user safeUser
+		err := json.Unmarshal(v, &user)
+		if err != nil {
+			return err
 		}
-		return b.ForEach(func(_, v []byte) error {
-			var user safeUser
-			err := json.Unmarshal(v, &user)
-			if err != nil {
-				return err
-			}
-			users = append(users, user)
-			return nil
-		})
-	}()
-
+		users = append(users, user)
+		return nil
+	})
 	if err != nil {
 		return c.Error(500, err)
 	}
@@ -112,19 +103,15 @@ func SafeListPost(c buffalo.Context) error {
 	// make sure email is in lowercase to avoid dupes and false negatives in safelist matches
 	form.List = strings.ToLower(form.List)
 	users := safeFormToSafeList(form)
-	btx := c.Value("btx").(*bbolt.Tx)
+	kv := c.Value("kv").(models.KV)
 	err := func() error {
-		b := btx.Bucket([]byte(safeUsersBucketName))
-		if b == nil {
-			return errBucketNotFound
-		}
 		for _, user := range users {
 			user.Responsible = responsible.Name
 			bson, err := json.Marshal(user)
 			if err != nil {
 				return err
 			}
-			err = b.Put([]byte(user.Email), bson)
+			err = kv.Put(safeUsersBucketName, []byte(user.Email), bson)
 			if err != nil {
 				return err
 			}
@@ -163,16 +150,8 @@ func SafeList(next buffalo.Handler) buffalo.Handler {
 			_ = setUserSafeRole(c, u)
 			return next(c)
 		}
-		var exists bool
-		btx := c.Value("btx").(*bbolt.Tx)
-		err := btx.DB().View(func(tx *bbolt.Tx) error {
-			b := tx.Bucket([]byte(safeUsersBucketName))
-			if b == nil {
-				return errBucketNotFound
-			}
-			exists = b.Get([]byte(email)) != nil
-			return nil
-		})
+		v, err := c.Value("kv").(models.KV).Get(safeUsersBucketName, []byte(email))
+		exists := v != nil
 		if err != nil {
 			c.Logger().Errorf("CRITICAL safelist malufunction: %s", err)
 			return next(c)
@@ -0,0 +1,110 @@
+package actions
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Minimal Office Open XML spreadsheet parts. A workbook with a single
+// sheet needs no more than these plus the sheet itself.
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+)
+
+// writeXLSX writes rows as an excel spreadsheet with a single sheet.
+// Cells which are numbers are written as numbers, the rest as text.
+func writeXLSX(w io.Writer, sheetName string, rows [][]string) error {
+	z := zip.NewWriter(w)
+	var name bytes.Buffer
+	if err := xml.EscapeText(&name, []byte(sheetName)); err != nil {
+		return err
+	}
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/workbook.xml", strings.Replace(xlsxWorkbook, "%s", name.String(), 1)},
+	}
+	for _, part := range parts {
+		f, err := z.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+	f, err := z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	if err = writeXLSXSheet(f, rows); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+func writeXLSXSheet(w io.Writer, rows [][]string) error {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range rows {
+		b.WriteString(`<row r="` + strconv.Itoa(i+1) + `">`)
+		for j, cell := range row {
+			ref := xlsxColumn(j) + strconv.Itoa(i+1)
+			if i > 0 && isDecimal(cell) {
+				b.WriteString(`<c r="` + ref + `"><v>` + cell + `</v></c>`)
+				continue
+			}
+			b.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t xml:space="preserve">`)
+			if err := xml.EscapeText(&b, []byte(cell)); err != nil {
+				return err
+			}
+			b.WriteString(`</t></is></c>`)
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// isDecimal reports whether s is a plain decimal number such as -12.5
+func isDecimal(s string) bool {
+	if strings.Trim(s, "-.0123456789") != "" {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// xlsxColumn returns the excel column name of the zero based column index i (A, B, ..., Z, AA, ...)
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
@@ -0,0 +1,25 @@
+package grifts
+
+import (
+	"fmt"
+
+	"github.com/IEEESBITBA/Curso-de-Python-Sistemas/models"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/markbates/grift/grift"
+)
+
+var _ = grift.Namespace("kv", func() {
+
+	_ = grift.Desc("migrate", "Copies key/value data from bbolt database to SQL tables. Run before setting KV_BACKEND=sql")
+	_ = grift.Add("migrate", func(c *grift.Context) error {
+		return models.DB.Transaction(func(tx *pop.Connection) error {
+			n, err := models.CopyBoltToSQL(models.BDB, tx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("copied %d keys from %s\n", n, models.BDB.Path())
+			return nil
+		})
+	})
+
+})
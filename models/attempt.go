@@ -0,0 +1,156 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gobuffalo/validate/v3/validators"
+	"github.com/gofrs/uuid"
+)
+
+// Attempt is a student's submission to an evaluation and its grade.
+// An attempt is stored every time the student's code is run against
+// the evaluation's test cases, including when the code errors.
+type Attempt struct {
+	ID           uuid.UUID    `json:"id" db:"id"`
+	UserID       uuid.UUID    `json:"user_id" db:"user_id"`
+	EvaluationID uuid.UUID    `json:"evaluation_id" db:"evaluation_id"`
+	TeamID       string       `json:"team_id" db:"team_id"`
+	Source       string       `json:"source" db:"source"`
+	Cases        AttemptCases `json:"cases" db:"cases"`
+	// Score is the weighted fraction of test cases passed
+	// multiplied by the evaluation's late multiplier if Late
+	Score  float64 `json:"score" db:"score"`
+	Passed bool    `json:"passed" db:"passed"`
+	// Late is set for attempts submitted after the evaluation's deadline
+	Late bool `json:"late" db:"late"`
+	// Error is the error which stopped grading, if any
+	Error     string    `json:"error" db:"error"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	// Non-DB fields
+	User       *User       `json:"-" db:"-"`
+	Evaluation *Evaluation `json:"-" db:"-"`
+}
+
+// AttemptCase is the result of running a single test case.
+// Hidden test cases are stored too.
+type AttemptCase struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Hidden   bool          `json:"hidden"`
+	Weight   float64       `json:"weight"`
+	Elapsed  time.Duration `json:"elapsed"`
+	Feedback string        `json:"feedback,omitempty"`
+}
+
+// AttemptCases is stored as JSON
+type AttemptCases []AttemptCase
+
+// Value implements driver.Valuer
+func (a AttemptCases) Value() (driver.Value, error) {
+	b, err := json.Marshal(a)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner
+func (a *AttemptCases) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(s, a)
+	case string:
+		return json.Unmarshal([]byte(s), a)
+	}
+	return errors.New("scan source was not []byte nor string")
+}
+
+// Elapsed is the total time spent running test cases
+func (a Attempt) Elapsed() (total time.Duration) {
+	for _, c := range a.Cases {
+		total += c.Elapsed
+	}
+	return total
+}
+
+// String is not required by pop and may be deleted
+func (a Attempt) String() string {
+	ja, _ := json.Marshal(a)
+	return string(ja)
+}
+
+// Attempts is not required by pop and may be deleted
+type Attempts []Attempt
+
+// String is not required by pop and may be deleted
+func (a Attempts) String() string {
+	ja, _ := json.Marshal(a)
+	return string(ja)
+}
+
+// AttemptSummaryColumns are the columns of attempts read by Attempts.Summarize.
+// Used to summarize attempts without reading their source and test cases.
+var AttemptSummaryColumns = []string{"id", "user_id", "evaluation_id", "score", "passed", "late", "created_at"}
+
+// AttemptSummary summarizes a student's attempts at an evaluation
+type AttemptSummary struct {
+	UserID       uuid.UUID
+	EvaluationID uuid.UUID
+	Attempts     int
+	BestScore    float64
+	// FirstPassed is the time of the first passing attempt. Zero if never passed
+	FirstPassed time.Time
+	// AttemptsToPass is the number of attempts up to and including the first pass
+	AttemptsToPass int
+	// PassedLate is set if the first passing attempt was late
+	PassedLate bool
+	Last       time.Time
+	// Non-DB fields taken from attempts
+	User       *User
+	Evaluation *Evaluation
+}
+
+// Summarize groups attempts by user and evaluation. Attempts must
+// be ordered by creation date, oldest first. Summaries are in
+// order of first attempt.
+func (a Attempts) Summarize() []AttemptSummary {
+	type key struct{ user, eval uuid.UUID }
+	index := make(map[key]int)
+	var sums []AttemptSummary
+	for _, at := range a {
+		k := key{at.UserID, at.EvaluationID}
+		i, ok := index[k]
+		if !ok {
+			i = len(sums)
+			index[k] = i
+			sums = append(sums, AttemptSummary{UserID: at.UserID, EvaluationID: at.EvaluationID,
+				User: at.User, Evaluation: at.Evaluation})
+		}
+		s := &sums[i]
+		s.Attempts++
+		s.Last = at.CreatedAt
+		if at.Score > s.BestScore {
+			s.BestScore = at.Score
+		}
+		if at.Passed && s.FirstPassed.IsZero() {
+			s.FirstPassed = at.CreatedAt
+			s.AttemptsToPass = s.Attempts
+			s.PassedLate = at.Late
+		}
+	}
+	return sums
+}
+
+// Validate gets run every time you call a "pop.Validate*" (pop.ValidateAndSave, pop.ValidateAndCreate, pop.ValidateAndUpdate) method.
+func (a *Attempt) Validate(tx *pop.Connection) (*validate.Errors, error) {
+	return validate.Validate(
+		&validators.UUIDIsPresent{Field: a.UserID, Name: "UserID"},
+		&validators.UUIDIsPresent{Field: a.EvaluationID, Name: "EvaluationID"},
+	), nil
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+func (ms *ModelSuite) Test_Attempt() {
+	user, eval := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	t0 := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	attempts := Attempts{
+		{UserID: user, EvaluationID: eval, Score: 0.2, CreatedAt: t0},
+		{UserID: user, EvaluationID: eval, Score: 0.8, Passed: true, Late: true, CreatedAt: t0.Add(time.Hour)},
+		{UserID: user, EvaluationID: eval, Score: 0.5, Passed: true, CreatedAt: t0.Add(2 * time.Hour)},
+	}
+	for i := range attempts {
+		attempts[i].Cases = AttemptCases{{Name: "1", Passed: attempts[i].Passed, Weight: 1, Elapsed: time.Millisecond}}
+		ms.NoError(ms.DB.Create(&attempts[i]))
+	}
+	var got Attempts
+	ms.NoError(ms.DB.Where("user_id = ?", user).Order("created_at ASC").All(&got))
+	ms.Len(got, 3)
+	ms.Equal(time.Millisecond, got[1].Elapsed())
+
+	sums := got.Summarize()
+	ms.Len(sums, 1)
+	ms.Equal(3, sums[0].Attempts)
+	ms.Equal(2, sums[0].AttemptsToPass)
+	ms.Equal(0.8, sums[0].BestScore)
+	ms.True(sums[0].FirstPassed.Equal(t0.Add(time.Hour)))
+	ms.True(sums[0].PassedLate)
+}
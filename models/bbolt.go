@@ -18,18 +18,81 @@ import (
 
 var errNonSuccess = errors.New("non success status code")
 
+// BoltTx is a bbolt transaction which is begun on first write. Handlers
+// get one from the context under "btx" and call View to read or Update
+// to write. Until a handler writes, each View runs in its own short
+// read-only transaction so requests which run python for a long time do
+// not hold a read-only transaction, which blocks writers when bbolt
+// needs to grow the database file.
+//
+// Byte slices obtained in View are only valid until fn returns and must
+// be copied to be used afterwards.
+type BoltTx struct {
+	db *bbolt.DB
+	// tx is the writable transaction, nil until Update is called
+	tx *bbolt.Tx
+}
+
+// NewBoltTx returns a BoltTx for db which has not begun a transaction
+func NewBoltTx(db *bbolt.DB) *BoltTx {
+	return &BoltTx{db: db}
+}
+
+// View calls fn with the writable transaction if one has begun so
+// reads see the request's writes, otherwise with a short read-only transaction.
+func (b *BoltTx) View(fn func(tx *bbolt.Tx) error) error {
+	if b.tx != nil {
+		return fn(b.tx)
+	}
+	return b.db.View(fn)
+}
+
+// Update returns the writable transaction, beginning one if none has begun.
+// It is held until the request ends so it should be called after running code.
+func (b *BoltTx) Update() (*bbolt.Tx, error) {
+	if b.tx != nil {
+		return b.tx, nil
+	}
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return nil, fmt.Errorf("in begin bbolt Tx: %s", err)
+	}
+	b.tx = tx
+	return tx, nil
+}
+
+// Writable reports whether a writable transaction has begun
+func (b *BoltTx) Writable() bool {
+	return b.tx != nil
+}
+
+// end commits the writable transaction if commit is true and rolls it back otherwise
+func (b *BoltTx) end(commit bool) error {
+	if b.tx == nil {
+		return nil
+	}
+	tx := b.tx
+	b.tx = nil
+	if commit {
+		return tx.Commit()
+	}
+	return tx.Rollback()
+}
+
 // BBoltTransaction is a piece of Buffalo middleware that wraps each
-// request in a BBoltDB transaction. The transaction will automatically get
-// committed if there's no errors and the response status code is a
-// 2xx or 3xx, otherwise it'll be rolled back. It will also add a
-// field to the log, "bdb", that shows the total duration spent during
-// the request writing + spilling + re-balancing.
+// request in a lazily begun BBoltDB transaction (see BoltTx). A writable
+// transaction will automatically get committed if there's no errors and
+// the response status code is a 2xx or 3xx, otherwise it'll be rolled back.
+// It will also add a field to the log, "bdb", that shows the total duration
+// spent during the request writing + spilling + re-balancing.
 // This function is nearly an identical copy of pop's Transaction()
 // just adapted to BBolt. Databases should be defined/initialized in models/models.go
-// One important thing to not is that a writable transaction locks the database
+// One important thing to note is that a writable transaction locks the database
 // to other writable transaction, which means only one transaction will be processed
-// if there are multiple goroutines waiting to read/write as only ONE read/write tx
-// can exist at a time. This may also not scale well if there
+// if there are multiple goroutines waiting to write as only ONE read/write tx
+// can exist at a time. Reads do not wait on each other nor on the writable
+// transaction, which is why no writable transaction is begun until a handler
+// asks to write. This may also not scale well if there
 // are many random write operations happening in a single transaction.
 // BBolt is more adept at small operations.
 // see https://github.com/boltdb/bolt#caveats--limitations for more information.
@@ -40,24 +103,20 @@ func BBoltTransaction(db *bbolt.DB) buffalo.MiddlewareFunc {
 			// of time doing things in the db to the log.
 			// ANY error returned by the tx function will cause the
 			// tx to be rolled back
-			bTx, err := db.Begin(true)
-			if err != nil {
-				return fmt.Errorf("in begin bbolt Tx: %s", err)
-			}
+			bTx := NewBoltTx(db)
 			// Wrap transaction in closure. this simplifies error handling
 			// all we gotta do is return the error and do checking outside
 			couldBeDBorYourErr := func() (txError error) {
 				// log database usage statistics to context
 				defer func() {
-					if txError != nil {
-						err = bTx.Rollback()
-					} else {
-						err = bTx.Commit()
-					}
-					if err != nil { // if BBoltDB fails we replace error
+					tx := bTx.tx
+					if err := bTx.end(txError == nil); err != nil { // if BBoltDB fails we replace error
 						txError = errx.Wrap(err, "BBoltDB committing/rolling back fail")
 					}
-					stats := bTx.Stats()
+					var stats bbolt.TxStats
+					if tx != nil {
+						stats = tx.Stats()
+					}
 					elapsed := stats.WriteTime + stats.SpillTime + stats.RebalanceTime
 					c.LogField("bdb", elapsed)
 				}()
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v5"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gobuffalo/validate/v3/validators"
+	"github.com/gofrs/uuid"
+)
+
+// DatasetMaxSize is the largest dataset that may be uploaded in bytes
+const DatasetMaxSize = 8 << 20
+
+// Dataset is a data file placed read-only in the working directory
+// of python runs so programs can open it by name, i.e. pandas.read_csv("notas.csv").
+// Course datasets are available to every run and evaluation datasets
+// only to runs of their evaluation.
+type Dataset struct {
+	ID uuid.UUID `json:"id" db:"id"`
+	// EvaluationID is the evaluation the dataset is attached to. Null for course datasets
+	EvaluationID nulls.UUID `json:"evaluation_id" db:"evaluation_id"`
+	// Name is the file name of the dataset in the working directory
+	Name      string    `json:"name" db:"name"`
+	Content   []byte    `json:"-" db:"content"`
+	Size      int       `json:"size" db:"size"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// DatasetColumns are the columns of datasets except content.
+// Used to list datasets without reading their contents.
+var DatasetColumns = []string{"id", "evaluation_id", "name", "size", "created_at", "updated_at"}
+
+// datasetNameRx matches file names with an extension which are not hidden
+var datasetNameRx = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*\.[A-Za-z0-9]+$`)
+
+// String is not required by pop and may be deleted
+func (d Dataset) String() string {
+	jd, _ := json.Marshal(d)
+	return string(jd)
+}
+
+// Datasets is not required by pop and may be deleted
+type Datasets []Dataset
+
+// String is not required by pop and may be deleted
+func (d Datasets) String() string {
+	jd, _ := json.Marshal(d)
+	return string(jd)
+}
+
+// Validate gets run every time you call a "pop.Validate*" (pop.ValidateAndSave, pop.ValidateAndCreate, pop.ValidateAndUpdate) method.
+func (d *Dataset) Validate(tx *pop.Connection) (*validate.Errors, error) {
+	q := tx.Where("name = ? AND id <> ?", d.Name, d.ID)
+	if d.EvaluationID.Valid {
+		q = q.Where("evaluation_id = ?", d.EvaluationID.UUID)
+	} else {
+		q = q.Where("evaluation_id IS NULL")
+	}
+	taken, err := q.Exists(&Dataset{})
+	if err != nil {
+		return nil, err
+	}
+	// datasets may not be python files since the program could import them in place of modules
+	return validate.Validate(
+		&validators.FuncValidator{Field: d.Name, Name: "Name", Message: "dataset name %q must be a file name with extension of letters, digits, '.', '-' or '_' and not a python file",
+			Fn: func() bool {
+				return len(d.Name) <= 100 && datasetNameRx.MatchString(d.Name) && !strings.HasSuffix(strings.ToLower(d.Name), ".py")
+			}},
+		&validators.FuncValidator{Field: d.Name, Name: "Name", Message: "dataset %q already exists",
+			Fn: func() bool { return !taken }},
+		&validators.FuncValidator{Field: fmt.Sprint(d.Size), Name: "Size", Message: "dataset size %s must not exceed " + fmt.Sprint(DatasetMaxSize) + " bytes",
+			Fn: func() bool { return d.Size <= DatasetMaxSize }},
+	), nil
+}
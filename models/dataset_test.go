@@ -0,0 +1,23 @@
+package models
+
+import (
+	"github.com/gobuffalo/nulls"
+	"github.com/gofrs/uuid"
+)
+
+func (ms *ModelSuite) Test_Dataset() {
+	eval := nulls.NewUUID(uuid.Must(uuid.NewV4()))
+	for _, name := range []string{"", ".hidden.csv", "f.py", "sin_extension", "../notas.csv", "dir/notas.csv"} {
+		verrs, err := ms.DB.ValidateAndCreate(&Dataset{Name: name, EvaluationID: eval})
+		ms.NoError(err)
+		ms.True(verrs.HasAny(), name)
+	}
+	ms.NoError(ms.DB.Create(&Dataset{Name: "notas.csv", EvaluationID: eval, Content: []byte("a,b\n1,2\n"), Size: 8}))
+	verrs, err := ms.DB.ValidateAndCreate(&Dataset{Name: "notas.csv", EvaluationID: eval})
+	ms.NoError(err)
+	ms.True(verrs.HasAny(), "name taken in evaluation")
+	// same name may be used by a course dataset
+	verrs, err = ms.DB.ValidateAndCreate(&Dataset{Name: "notas.csv"})
+	ms.NoError(err)
+	ms.False(verrs.HasAny())
+}
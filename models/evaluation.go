@@ -2,12 +2,19 @@ package models
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gobuffalo/nulls"
 	"github.com/gobuffalo/pop/v5"
+	"github.com/gobuffalo/pop/v5/slices"
 	"github.com/gobuffalo/validate/v3"
 	"github.com/gobuffalo/validate/v3/validators"
+	yaml "github.com/goccy/go-yaml"
 	"github.com/gofrs/uuid"
 )
 
@@ -21,8 +28,275 @@ type Evaluation struct {
 	Hidden      bool         `json:"hidden" db:"hidden" form:"hidden"`
 	Deleted     bool         `json:"deleted" db:"deleted" form:"deleted"`
 	Inputs      nulls.String `json:"inputs" db:"inputs" form:"stdin"`
-	CreatedAt   time.Time    `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time    `json:"updated_at" db:"updated_at"`
+	// Final evaluations must be passed to submit forms which require final evaluations
+	Final bool `json:"final" db:"final" form:"-"`
+	// Prerequisites are the IDs of evaluations which must be passed before submitting to this one
+	Prerequisites slices.UUID `json:"prerequisites" db:"prerequisites" form:"-"`
+	// PassThreshold is the minimum weighted fraction of test cases passed needed to pass evaluation
+	PassThreshold float64 `json:"pass_threshold" db:"pass_threshold" form:"pass_threshold"`
+	// Comparator is the default comparator spec of test cases. See ParseComparator
+	Comparator string `json:"comparator" db:"comparator" form:"comparator"`
+	// Checker is a python script used by the checker comparator
+	Checker nulls.String `json:"checker" db:"checker" form:"checker"`
+	// Kind is how submissions are graded. See EvaluationKindOutput and EvaluationKindUnitTest
+	Kind string `json:"kind" db:"kind" form:"kind"`
+	// Harness is the python script which tests functions of submissions of unit test evaluations
+	Harness nulls.String `json:"harness" db:"harness" form:"harness"`
+	// Availability window. OpensAt and ClosesAt unset mean always open and no deadline.
+	// Submissions after ClosesAt and up to LateUntil are late and their score is
+	// multiplied by LateMultiplier. Times are set from forms by the actions package
+	OpensAt        nulls.Time `json:"opens_at" db:"opens_at" form:"-"`
+	ClosesAt       nulls.Time `json:"closes_at" db:"closes_at" form:"-"`
+	LateUntil      nulls.Time `json:"late_until" db:"late_until" form:"-"`
+	LateMultiplier float64    `json:"late_multiplier" db:"late_multiplier" form:"late_multiplier"`
+	// Sandbox policy. Empty values use the interpreter defaults
+	AllowedImports  nulls.String `json:"allowed_imports" db:"allowed_imports" form:"allowed_imports"`
+	ForbiddenNames  nulls.String `json:"forbidden_names" db:"forbidden_names" form:"forbidden_names"`
+	MaxSourceLength int          `json:"max_source_length" db:"max_source_length" form:"max_source_length"`
+	Timeout         string       `json:"timeout" db:"timeout" form:"timeout"`
+	CreatedAt       time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time    `json:"updated_at" db:"updated_at"`
+}
+
+const (
+	// EvaluationMaxTimeout is the longest timeout an evaluation may have
+	EvaluationMaxTimeout = 10 * time.Second
+	// EvaluationDefaultPassThreshold is the pass threshold of new evaluations
+	EvaluationDefaultPassThreshold = 0.4
+	// EvaluationDefaultLateMultiplier is the late multiplier of new evaluations
+	EvaluationDefaultLateMultiplier = 1.
+)
+
+// Evaluation kinds
+const (
+	// EvaluationKindOutput evaluations run submissions with the stdin of
+	// each test case and compare their output. Empty kind is output
+	EvaluationKindOutput = "output"
+	// EvaluationKindUnitTest evaluations run the evaluation's harness which
+	// imports the submission as module EvaluationUnitTestModule, calls its
+	// functions and prints results of its tests as JSON on the last line
+	EvaluationKindUnitTest = "unittest"
+	// EvaluationUnitTestModule is the module name of submissions in unit test harnesses
+	EvaluationUnitTestModule = "alumno"
+)
+
+// UnitTest reports whether submissions are graded by the evaluation's harness
+func (e Evaluation) UnitTest() bool {
+	return e.Kind == EvaluationKindUnitTest
+}
+
+// Availability of an evaluation. See Evaluation.Availability
+const (
+	EvaluationNotOpen = "not-open"
+	EvaluationOpen    = "open"
+	EvaluationLate    = "late"
+	EvaluationClosed  = "closed"
+)
+
+// Availability returns whether submissions are accepted at time t
+func (e Evaluation) Availability(t time.Time) string {
+	switch {
+	case e.OpensAt.Valid && t.Before(e.OpensAt.Time):
+		return EvaluationNotOpen
+	case !e.ClosesAt.Valid || !t.After(e.ClosesAt.Time):
+		return EvaluationOpen
+	case e.LateUntil.Valid && !t.After(e.LateUntil.Time):
+		return EvaluationLate
+	}
+	return EvaluationClosed
+}
+
+// Status is the availability of the evaluation now
+func (e Evaluation) Status() string {
+	return e.Availability(time.Now())
+}
+
+// Requires returns true if evaluation id is a prerequisite of e
+func (e Evaluation) Requires(id uuid.UUID) bool {
+	for _, p := range e.Prerequisites {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// TestCase is a single test case of an evaluation. If Expected
+// is nil the expected output is obtained by running the evaluation's solution.
+type TestCase struct {
+	Name     string  `json:"name" yaml:"name"`
+	Stdin    string  `json:"stdin" yaml:"stdin"`
+	Expected *string `json:"expected,omitempty" yaml:"expected"`
+	Weight   float64 `json:"weight" yaml:"weight"`
+	Hidden   bool    `json:"hidden" yaml:"hidden"`
+	// Comparator overrides the evaluation's comparator
+	Comparator string `json:"comparator,omitempty" yaml:"comparator"`
+}
+
+// Comparator modes
+const (
+	CompareExact      = "exact"
+	CompareWhitespace = "whitespace"
+	CompareUnordered  = "unordered"
+	CompareFloat      = "float"
+	CompareRegex      = "regex"
+	CompareChecker    = "checker"
+)
+
+// Comparator decides how a program's output is compared
+// with the expected output of a test case.
+type Comparator struct {
+	Mode string
+	// Abs and Rel are the tolerances of float comparison
+	Abs, Rel float64
+}
+
+// ParseComparator parses a comparator spec. Valid specs are
+//
+//	exact       outputs must be identical (default)
+//	whitespace  outputs must have the same whitespace separated fields
+//	unordered   outputs must have the same lines in any order
+//	float       as whitespace but numbers may differ by abs=1e-6 or rel=1e-6
+//	float:abs=1e-3,rel=0  float with custom tolerances
+//	regex       expected output is a regular expression which must match all of output
+//	checker     the evaluation's checker script decides
+//
+// An empty spec is exact.
+func ParseComparator(spec string) (Comparator, error) {
+	spec = strings.TrimSpace(spec)
+	mode, opts := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		mode, opts = spec[:i], spec[i+1:]
+	}
+	cmp := Comparator{Mode: strings.ToLower(mode)}
+	switch cmp.Mode {
+	case "":
+		cmp.Mode = CompareExact
+	case CompareExact, CompareWhitespace, CompareUnordered, CompareRegex, CompareChecker:
+	case CompareFloat:
+		cmp.Abs, cmp.Rel = 1e-6, 1e-6
+	default:
+		return cmp, fmt.Errorf("unknown comparator %q", mode)
+	}
+	if opts != "" && cmp.Mode != CompareFloat {
+		return cmp, fmt.Errorf("comparator %q takes no options", mode)
+	}
+	for _, opt := range strings.FieldsFunc(opts, func(r rune) bool { return r == ',' }) {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return cmp, fmt.Errorf("comparator option %q must be key=value", opt)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || v < 0 {
+			return cmp, fmt.Errorf("comparator option %q must be a non-negative number", opt)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "abs":
+			cmp.Abs = v
+		case "rel":
+			cmp.Rel = v
+		default:
+			return cmp, fmt.Errorf("unknown comparator option %q", kv[0])
+		}
+	}
+	return cmp, nil
+}
+
+// CaseComparator returns the comparator of a test case
+func (e Evaluation) CaseComparator(tc TestCase) (Comparator, error) {
+	if tc.Comparator != "" {
+		return ParseComparator(tc.Comparator)
+	}
+	return ParseComparator(e.Comparator)
+}
+
+// TestCases parses Inputs. Inputs starting with "cases:" or "{" are
+// parsed as a YAML (or JSON) document with a list of cases under the
+// cases key, i.e:
+//
+//	cases:
+//	- name: primos
+//	  stdin: "7"
+//	  expected: "True"
+//	  weight: 2
+//	  hidden: true
+//
+// Otherwise Inputs are a list of stdin separated by lines
+// containing "---", each one a visible test case of weight 1.
+// Weight defaults to 1 and a trailing newline is added to
+// expected outputs missing one, as print does.
+func (e Evaluation) TestCases() ([]TestCase, error) {
+	inputs := strings.ReplaceAll(e.Inputs.String, "\r", "")
+	trimmed := strings.TrimSpace(inputs)
+	if !strings.HasPrefix(trimmed, "cases:") && !strings.HasPrefix(trimmed, "{") {
+		var cases []TestCase
+		for i, stdin := range strings.Split(inputs, "---\n") {
+			cases = append(cases, TestCase{Name: strconv.Itoa(i + 1), Stdin: stdin, Weight: 1})
+		}
+		return cases, nil
+	}
+	var doc struct {
+		Cases []struct {
+			TestCase `yaml:",inline"`
+			Weight   *float64 `yaml:"weight"`
+		} `yaml:"cases"`
+	}
+	if err := yaml.Unmarshal([]byte(inputs), &doc); err != nil {
+		return nil, fmt.Errorf("parsing test cases: %s", err)
+	}
+	if len(doc.Cases) == 0 {
+		return nil, errors.New("no test cases found")
+	}
+	cases := make([]TestCase, len(doc.Cases))
+	var total float64
+	for i, c := range doc.Cases {
+		cases[i] = c.TestCase
+		cases[i].Weight = 1
+		if c.Weight != nil {
+			cases[i].Weight = *c.Weight
+		}
+		if cases[i].Weight < 0 {
+			return nil, fmt.Errorf("test case %d has negative weight", i+1)
+		}
+		total += cases[i].Weight
+		if cases[i].Name == "" {
+			cases[i].Name = strconv.Itoa(i + 1)
+		}
+		if exp := cases[i].Expected; exp != nil && !strings.HasSuffix(*exp, "\n") {
+			withNewline := *exp + "\n"
+			cases[i].Expected = &withNewline
+		}
+	}
+	if total == 0 {
+		return nil, errors.New("test case weights add up to 0")
+	}
+	return cases, nil
+}
+
+// PolicyList splits a comma or whitespace separated list
+// such as AllowedImports or ForbiddenNames
+func PolicyList(s nulls.String) []string {
+	return strings.FieldsFunc(s.String, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// checkTestCases checks test cases and their comparators are valid
+func (e Evaluation) checkTestCases() error {
+	cases, err := e.TestCases()
+	if err != nil {
+		return err
+	}
+	for _, tc := range cases {
+		cmp, err := e.CaseComparator(tc)
+		if err != nil {
+			return fmt.Errorf("test case %s: %s", tc.Name, err)
+		}
+		if cmp.Mode == CompareChecker && strings.TrimSpace(e.Checker.String) == "" {
+			return fmt.Errorf("test case %s uses checker comparator but evaluation has no checker", tc.Name)
+		}
+	}
+	return nil
 }
 
 // String is not required by pop and may be deleted
@@ -48,14 +322,87 @@ func (e Evaluations) String() string {
 	return string(je)
 }
 
+// MissingPrerequisites returns the prerequisites of eval in e which user
+// has not passed. Deleted prerequisites and those not in e are not required.
+func (e Evaluations) MissingPrerequisites(eval Evaluation, user *User) Evaluations {
+	var missing Evaluations
+	for _, p := range e {
+		if eval.Requires(p.ID) && !p.Deleted && !user.Subscribed(p.ID) {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// PrerequisiteCycle returns true if eval, replacing its stored version
+// in e, would depend on itself through prerequisites.
+func (e Evaluations) PrerequisiteCycle(eval Evaluation) bool {
+	prereqs := make(map[uuid.UUID]slices.UUID, len(e)+1)
+	for _, p := range e {
+		prereqs[p.ID] = p.Prerequisites
+	}
+	prereqs[eval.ID] = eval.Prerequisites
+	visited := make(map[uuid.UUID]bool)
+	pending := append(slices.UUID{}, eval.Prerequisites...)
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if id == eval.ID {
+			return true
+		}
+		if !visited[id] {
+			visited[id] = true
+			pending = append(pending, prereqs[id]...)
+		}
+	}
+	return false
+}
+
 // Validate gets run every time you call a "pop.Validate*" (pop.ValidateAndSave, pop.ValidateAndCreate, pop.ValidateAndUpdate) method.
 // This method is not required and may be deleted.
 func (e *Evaluation) Validate(tx *pop.Connection) (*validate.Errors, error) {
+	var casesErr string
+	if err := e.checkTestCases(); err != nil && !e.UnitTest() {
+		casesErr = err.Error()
+	}
+	var others Evaluations
+	if tx != nil {
+		if err := tx.Where("deleted = ?", false).All(&others); err != nil {
+			return nil, err
+		}
+	}
 	return validate.Validate(
 		&validators.StringIsPresent{Field: e.Title, Name: "Title"},
 		&validators.StringIsPresent{Field: e.Description, Name: "Description"},
 		&validators.StringIsPresent{Field: e.Content, Name: "Content"},
 		&validators.StringIsPresent{Field: e.Solution, Name: "Solution"},
+		&validators.FuncValidator{Field: casesErr, Name: "Inputs", Message: "invalid test cases: %s",
+			Fn: func() bool { return casesErr == "" }},
+		&validators.FuncValidator{Field: e.Kind, Name: "Kind", Message: "unknown evaluation kind %q",
+			Fn: func() bool {
+				return e.Kind == "" || e.Kind == EvaluationKindOutput || e.Kind == EvaluationKindUnitTest
+			}},
+		&validators.FuncValidator{Field: e.Kind, Name: "Harness", Message: "%s evaluations require a harness",
+			Fn: func() bool { return !e.UnitTest() || strings.TrimSpace(e.Harness.String) != "" }},
+		&validators.FuncValidator{Field: e.ClosesAt.Time.String(), Name: "ClosesAt", Message: "deadline %s must be after opening time",
+			Fn: func() bool { return !e.OpensAt.Valid || !e.ClosesAt.Valid || e.ClosesAt.Time.After(e.OpensAt.Time) }},
+		&validators.FuncValidator{Field: e.LateUntil.Time.String(), Name: "LateUntil", Message: "end of late submissions %s must be after the deadline",
+			Fn: func() bool { return !e.LateUntil.Valid || e.ClosesAt.Valid && e.LateUntil.Time.After(e.ClosesAt.Time) }},
+		&validators.FuncValidator{Field: fmt.Sprint(e.LateMultiplier), Name: "LateMultiplier", Message: "late multiplier %s must be between 0 and 1",
+			Fn: func() bool { return e.LateMultiplier >= 0 && e.LateMultiplier <= 1 }},
+		&validators.FuncValidator{Field: e.Title, Name: "Prerequisites", Message: "evaluation %q can't depend on itself through prerequisites",
+			Fn: func() bool { return !others.PrerequisiteCycle(*e) }},
+		&validators.FuncValidator{Field: fmt.Sprint(e.PassThreshold), Name: "PassThreshold", Message: "pass threshold %s must be between 0 and 1",
+			Fn: func() bool { return e.PassThreshold >= 0 && e.PassThreshold <= 1 }},
+		&validators.IntIsGreaterThan{Field: e.MaxSourceLength, Name: "MaxSourceLength", Compared: -1},
+		&validators.FuncValidator{Field: e.Timeout, Name: "Timeout", Message: "timeout %q must be a duration such as 500ms and not exceed " + EvaluationMaxTimeout.String(),
+			Fn: func() bool {
+				if e.Timeout == "" {
+					return true
+				}
+				d, err := time.ParseDuration(e.Timeout)
+				return err == nil && d > 0 && d <= EvaluationMaxTimeout
+			}},
 	), nil
 }
 
@@ -1,5 +1,74 @@
 package models
 
+import (
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v5/slices"
+	"github.com/gofrs/uuid"
+)
+
 func (ms *ModelSuite) Test_Evaluation() {
 	ms.Fail("This test needs to be implemented!")
 }
+
+func (ms *ModelSuite) Test_Evaluation_UnitTest() {
+	eval := &Evaluation{Title: "Primos", Description: "d", Content: "c", Solution: "def es_primo(n): pass",
+		PassThreshold: 0.5, Kind: EvaluationKindUnitTest}
+	verrs, err := eval.Validate(nil)
+	ms.NoError(err)
+	ms.True(verrs.HasAny(), "harness required")
+	eval.Harness = nulls.NewString("import alumno")
+	verrs, err = eval.Validate(nil)
+	ms.NoError(err)
+	ms.False(verrs.HasAny(), verrs.Error())
+	eval.Kind = "stdout"
+	verrs, err = eval.Validate(nil)
+	ms.NoError(err)
+	ms.True(verrs.HasAny(), "unknown kind")
+}
+
+func (ms *ModelSuite) Test_Evaluation_Availability() {
+	t0 := time.Date(2021, 3, 10, 9, 0, 0, 0, time.UTC)
+	eval := &Evaluation{Title: "Primos", Description: "d", Content: "c", Solution: "print(2)", Inputs: nulls.NewString("1"),
+		PassThreshold: 0.5, LateMultiplier: 0.5}
+	ms.Equal(EvaluationOpen, eval.Availability(t0))
+	eval.OpensAt = nulls.NewTime(t0)
+	eval.ClosesAt = nulls.NewTime(t0.Add(time.Hour))
+	ms.Equal(EvaluationNotOpen, eval.Availability(t0.Add(-time.Minute)))
+	ms.Equal(EvaluationOpen, eval.Availability(t0.Add(time.Hour)))
+	ms.Equal(EvaluationClosed, eval.Availability(t0.Add(time.Hour+time.Minute)))
+	eval.LateUntil = nulls.NewTime(t0.Add(2 * time.Hour))
+	ms.Equal(EvaluationLate, eval.Availability(t0.Add(time.Hour+time.Minute)))
+	ms.Equal(EvaluationClosed, eval.Availability(t0.Add(3*time.Hour)))
+
+	verrs, err := eval.Validate(nil)
+	ms.NoError(err)
+	ms.False(verrs.HasAny(), verrs.Error())
+	eval.LateUntil = nulls.NewTime(t0)
+	verrs, err = eval.Validate(nil)
+	ms.NoError(err)
+	ms.True(verrs.HasAny(), "late until before deadline")
+	eval.LateUntil, eval.ClosesAt = nulls.Time{}, nulls.NewTime(t0.Add(-time.Hour))
+	verrs, err = eval.Validate(nil)
+	ms.NoError(err)
+	ms.True(verrs.HasAny(), "deadline before opening")
+}
+
+func (ms *ModelSuite) Test_Evaluation_Prerequisites() {
+	a := Evaluation{ID: uuid.Must(uuid.NewV4()), Title: "Uno"}
+	b := Evaluation{ID: uuid.Must(uuid.NewV4()), Title: "Dos", Prerequisites: slices.UUID{a.ID}}
+	c := Evaluation{ID: uuid.Must(uuid.NewV4()), Title: "Tres", Prerequisites: slices.UUID{b.ID}}
+	evals := Evaluations{a, b, c}
+	user := &User{}
+	ms.Len(evals.MissingPrerequisites(a, user), 0)
+	ms.Len(evals.MissingPrerequisites(c, user), 1)
+	user.AddSubscription(b.ID)
+	ms.Len(evals.MissingPrerequisites(c, user), 0)
+
+	ms.False(evals.PrerequisiteCycle(c))
+	a.Prerequisites = slices.UUID{c.ID}
+	ms.True(evals.PrerequisiteCycle(a))
+	a.Prerequisites = slices.UUID{a.ID}
+	ms.True(Evaluations{}.PrerequisiteCycle(a))
+}
@@ -0,0 +1,410 @@
+package models
+
+// Key/value storage used by the python interpreter and the safelist.
+// Data is organized in buckets which are either bbolt buckets
+// or SQL tables named after the bucket (i.e. pyUploads is stored
+// in the py_uploads table). The backend is chosen with the
+// KV_BACKEND environment variable: "bolt" (default) or "sql".
+// The SQL backend allows running many instances of the app
+// against the same database.
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/flect"
+	"github.com/gobuffalo/pop/v5"
+	"go.etcd.io/bbolt"
+)
+
+// KVBuckets are the buckets available in key/value storage. Any new
+// bucket must be added here and have its table created in a migration.
+var KVBuckets = []string{"pyUploads", "pyUploadsTime", "safeUsers", "pyEvalCache"}
+
+// KV is a transactional key/value store. Writes are committed
+// or rolled back along with the request's transaction.
+type KV interface {
+	// Get returns value stored under key or nil if there is none.
+	Get(bucket string, key []byte) ([]byte, error)
+	// Put stores value under key, replacing the previous value.
+	Put(bucket string, key, value []byte) error
+	// PutIfAbsent stores value under key unless key exists. Returns whether value was stored.
+	// Checking and storing is atomic.
+	PutIfAbsent(bucket string, key, value []byte) (bool, error)
+	// Delete deletes key. Deleting a missing key is not an error.
+	Delete(bucket string, key []byte) error
+	// ForEach calls fn with every key starting with prefix in ascending
+	// key order. An empty prefix iterates over the whole bucket.
+	// fn must not write to the KV, collect keys and write after ForEach returns.
+	ForEach(bucket string, prefix []byte, fn func(k, v []byte) error) error
+	// ForEachReverse calls fn with every key lower than before in descending
+	// key order. A nil before iterates over the whole bucket.
+	// fn must not write to the KV, same as ForEach.
+	ForEachReverse(bucket string, before []byte, fn func(k, v []byte) error) error
+	// Clear deletes all keys in bucket.
+	Clear(bucket string) error
+	// Stats returns amount of keys and approximate storage used by bucket.
+	Stats(bucket string) (KVStats, error)
+}
+
+// KVStats is the size of a bucket
+type KVStats struct {
+	Keys  int   `json:"keys" db:"keys"`
+	Bytes int64 `json:"bytes" db:"bytes"`
+}
+
+// KVBackend is the KV implementation used for requests. Set in init()
+var KVBackend string
+
+func init() {
+	KVBackend = envy.Get("KV_BACKEND", "bolt")
+	if KVBackend != "bolt" && KVBackend != "sql" {
+		panic("KV_BACKEND must be bolt or sql. got " + KVBackend)
+	}
+}
+
+// KVTransaction is a piece of Buffalo middleware which sets the request's
+// KV in the context under "kv". It must be used after pop's Transaction
+// and BBoltTransaction middleware since KV uses their transactions.
+//  c.Value("kv").(models.KV)
+func KVTransaction(next buffalo.Handler) buffalo.Handler {
+	return func(c buffalo.Context) error {
+		if KVBackend == "sql" {
+			c.Set("kv", NewSQLKV(c.Value("tx").(*pop.Connection)))
+		} else {
+			c.Set("kv", NewBoltKV(c.Value("btx").(*BoltTx)))
+		}
+		return next(c)
+	}
+}
+
+// KVUpdate runs fn with the configured KV outside of a request. The
+// transaction is committed if fn returns nil and rolled back otherwise.
+func KVUpdate(fn func(KV) error) error {
+	if KVBackend == "sql" {
+		return DB.Transaction(func(tx *pop.Connection) error {
+			return fn(NewSQLKV(tx))
+		})
+	}
+	btx := NewBoltTx(BDB)
+	err := fn(NewBoltKV(btx))
+	if endErr := btx.end(err == nil); err == nil {
+		err = endErr
+	}
+	return err
+}
+
+func checkBucket(bucket string) error {
+	for _, b := range KVBuckets {
+		if b == bucket {
+			return nil
+		}
+	}
+	return fmt.Errorf("key/value bucket %q does not exist", bucket)
+}
+
+// boltKV stores buckets in bbolt. Reads use short read-only
+// transactions until the first write. See BoltTx.
+type boltKV struct {
+	btx *BoltTx
+}
+
+// NewBoltKV returns a KV which uses btx
+func NewBoltKV(btx *BoltTx) KV {
+	return boltKV{btx: btx}
+}
+
+func (b boltKV) Get(bucket string, key []byte) ([]byte, error) {
+	if err := checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	var value []byte
+	err := b.btx.View(func(tx *bbolt.Tx) error {
+		if bkt := tx.Bucket([]byte(bucket)); bkt != nil {
+			// values are only valid during the transaction
+			value = copyBytes(bkt.Get(key))
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (b boltKV) Put(bucket string, key, value []byte) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	tx, err := b.btx.Update()
+	if err != nil {
+		return err
+	}
+	bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return bkt.Put(key, value)
+}
+
+func (b boltKV) PutIfAbsent(bucket string, key, value []byte) (bool, error) {
+	if err := checkBucket(bucket); err != nil {
+		return false, err
+	}
+	tx, err := b.btx.Update()
+	if err != nil {
+		return false, err
+	}
+	bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil || bkt.Get(key) != nil {
+		return false, err
+	}
+	return true, bkt.Put(key, value)
+}
+
+func (b boltKV) Delete(bucket string, key []byte) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	tx, err := b.btx.Update()
+	if err != nil {
+		return err
+	}
+	bkt := tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return nil
+	}
+	return bkt.Delete(key)
+}
+
+func (b boltKV) ForEach(bucket string, prefix []byte, fn func(k, v []byte) error) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	return b.btx.View(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		cur := bkt.Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			if err := fn(copyBytes(k), copyBytes(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b boltKV) ForEachReverse(bucket string, before []byte, fn func(k, v []byte) error) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	return b.btx.View(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		cur := bkt.Cursor()
+		var k, v []byte
+		if before == nil {
+			k, v = cur.Last()
+		} else if k, _ = cur.Seek(before); k == nil {
+			// every key is lower than before
+			k, v = cur.Last()
+		} else {
+			k, v = cur.Prev()
+		}
+		for ; k != nil; k, v = cur.Prev() {
+			if err := fn(copyBytes(k), copyBytes(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b boltKV) Clear(bucket string) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	tx, err := b.btx.Update()
+	if err != nil {
+		return err
+	}
+	if err = tx.DeleteBucket([]byte(bucket)); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
+	_, err = tx.CreateBucket([]byte(bucket))
+	return err
+}
+
+func (b boltKV) Stats(bucket string) (KVStats, error) {
+	if err := checkBucket(bucket); err != nil {
+		return KVStats{}, err
+	}
+	var stats KVStats
+	err := b.btx.View(func(tx *bbolt.Tx) error {
+		if bkt := tx.Bucket([]byte(bucket)); bkt != nil {
+			st := bkt.Stats()
+			stats = KVStats{Keys: st.KeyN, Bytes: int64(st.BranchInuse + st.LeafInuse + st.InlineBucketInuse)}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// sqlKV stores each bucket in a table with key and value columns
+type sqlKV struct {
+	tx *pop.Connection
+}
+
+// NewSQLKV returns a KV which uses tx
+func NewSQLKV(tx *pop.Connection) KV {
+	return sqlKV{tx: tx}
+}
+
+type kvRow struct {
+	Key   []byte `db:"key"`
+	Value []byte `db:"value"`
+}
+
+// KVTable returns the name of the SQL table in which bucket is stored
+func KVTable(bucket string) string {
+	return flect.Underscore(bucket)
+}
+
+func (s sqlKV) Get(bucket string, key []byte) ([]byte, error) {
+	if err := checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	var rows []kvRow
+	err := s.tx.RawQuery(`SELECT key, value FROM "`+KVTable(bucket)+`" WHERE key = ?`, key).All(&rows)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return rows[0].Value, nil
+}
+
+func (s sqlKV) Put(bucket string, key, value []byte) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	return s.tx.RawQuery(`INSERT INTO "`+KVTable(bucket)+`" (key, value, created_at, updated_at) VALUES (?, ?, now(), now())
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = now()`, key, value).Exec()
+}
+
+func (s sqlKV) PutIfAbsent(bucket string, key, value []byte) (bool, error) {
+	if err := checkBucket(bucket); err != nil {
+		return false, err
+	}
+	n, err := s.tx.RawQuery(`INSERT INTO "`+KVTable(bucket)+`" (key, value, created_at, updated_at) VALUES (?, ?, now(), now())
+ON CONFLICT (key) DO NOTHING`, key, value).ExecWithCount()
+	return n > 0, err
+}
+
+func (s sqlKV) Delete(bucket string, key []byte) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	return s.tx.RawQuery(`DELETE FROM "`+KVTable(bucket)+`" WHERE key = ?`, key).Exec()
+}
+
+func (s sqlKV) ForEach(bucket string, prefix []byte, fn func(k, v []byte) error) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	var rows []kvRow
+	err := s.tx.RawQuery(`SELECT key, value FROM "`+KVTable(bucket)+`" WHERE substring(key from 1 for ?) = ? ORDER BY key`,
+		len(prefix), prefix).All(&rows)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err = fn(row.Key, row.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlKVReverseBatch is the amount of rows ForEachReverse reads per query
+const sqlKVReverseBatch = 100
+
+func (s sqlKV) ForEachReverse(bucket string, before []byte, fn func(k, v []byte) error) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	for {
+		var rows []kvRow
+		var err error
+		if before == nil {
+			err = s.tx.RawQuery(`SELECT key, value FROM "`+KVTable(bucket)+`" ORDER BY key DESC LIMIT ?`,
+				sqlKVReverseBatch).All(&rows)
+		} else {
+			err = s.tx.RawQuery(`SELECT key, value FROM "`+KVTable(bucket)+`" WHERE key < ? ORDER BY key DESC LIMIT ?`,
+				before, sqlKVReverseBatch).All(&rows)
+		}
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err = fn(row.Key, row.Value); err != nil {
+				return err
+			}
+		}
+		if len(rows) < sqlKVReverseBatch {
+			return nil
+		}
+		before = rows[len(rows)-1].Key
+	}
+}
+
+func (s sqlKV) Clear(bucket string) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	return s.tx.RawQuery(`DELETE FROM "` + KVTable(bucket) + `"`).Exec()
+}
+
+func (s sqlKV) Stats(bucket string) (KVStats, error) {
+	if err := checkBucket(bucket); err != nil {
+		return KVStats{}, err
+	}
+	var st []KVStats
+	err := s.tx.RawQuery(`SELECT count(*) AS keys, coalesce(sum(octet_length(key) + octet_length(value)), 0) AS bytes FROM "` +
+		KVTable(bucket) + `"`).All(&st)
+	if err != nil || len(st) == 0 {
+		return KVStats{}, err
+	}
+	return st[0], nil
+}
+
+// CopyBoltToSQL copies all buckets in KVBuckets from db to the SQL tables
+// using tx. Keys already present in SQL are overwritten. Returns amount of keys copied.
+func CopyBoltToSQL(db *bbolt.DB, tx *pop.Connection) (n int, err error) {
+	kv := NewSQLKV(tx)
+	err = db.View(func(btx *bbolt.Tx) error {
+		for _, bucket := range KVBuckets {
+			bkt := btx.Bucket([]byte(bucket))
+			if bkt == nil {
+				continue
+			}
+			err := bkt.ForEach(func(k, v []byte) error {
+				n++
+				return kv.Put(bucket, k, v)
+			})
+			if err != nil {
+				return fmt.Errorf("copying bucket %s: %s", bucket, err)
+			}
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestBoltKVForEachReverse(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "kv.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	btx := NewBoltTx(db)
+	defer btx.end(false)
+	kv := NewBoltKV(btx)
+	for _, k := range []string{"b", "d", "a", "c"} {
+		if err = kv.Put("pyUploadsTime", []byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		name, before, want string
+	}{
+		{name: "whole bucket", want: "dcba"},
+		{name: "before key", before: "c", want: "ba"},
+		{name: "before missing key", before: "bb", want: "ba"},
+		{name: "before all keys", before: "a"},
+		{name: "after all keys", before: "z", want: "dcba"},
+	} {
+		var before []byte
+		if test.before != "" {
+			before = []byte(test.before)
+		}
+		var got strings.Builder
+		err = kv.ForEachReverse("pyUploadsTime", before, func(k, _ []byte) error {
+			got.Write(k)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != test.want {
+			t.Errorf("%s: got keys %q, want %q", test.name, got.String(), test.want)
+		}
+	}
+}
@@ -41,12 +41,12 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	// any new bucket names must be created here
+	// any new bucket names must be added to KVBuckets
 	_ = BDB.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("pyUploads"))
-		must(err)
-		_, err = tx.CreateBucketIfNotExists([]byte("safeUsers"))
-		must(err)
+		for _, bucket := range KVBuckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			must(err)
+		}
 		return nil
 	})
 }